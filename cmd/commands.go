@@ -0,0 +1,650 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go-hana/internal/config"
+	"go-hana/internal/hana"
+	"go-hana/internal/schedulers"
+	"go-hana/internal/supervisor"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// output formats of the reports
+	FORMAT_JSON  = "json"
+	FORMAT_TABLE = "table"
+)
+
+// action is what a command does once the configuration is loaded and the
+// databases are connected.
+type action func(ctx context.Context, a *app) error
+
+// command is a subcommand of the binary.
+type command struct {
+	name string
+	// args is the synopsis of the arguments
+	args string
+	help string
+	// schema requires the schema version of this build before the action
+	// runs, only migrate up changes it
+	schema bool
+	// parse parses the arguments of the command with fs, before the
+	// databases are connected, and returns its action
+	parse func(fs *flag.FlagSet, args []string) (action, error)
+}
+
+// commands are the subcommands in the order of the usage.
+var commands = []command{
+	{
+		name:   "run",
+		help:   "Runs the schedulers of all entities as a service until SIGINT or SIGTERM. It is the default command.",
+		schema: true,
+		parse:  parseRun,
+	},
+	{
+		name:  "migrate",
+		args:  "up | down [-to version] | status [-format table|json]",
+		help:  "Applies the pending migrations, reverts migrations or lists the state of every migration.",
+		parse: parseMigrate,
+	},
+	{
+		name:   "sync",
+		args:   "[-entity entity] [-once]",
+		help:   "Loads one or all entities in the foreground, continuously or for a single pass.",
+		schema: true,
+		parse:  parseSync,
+	},
+	{
+		name:  "drop",
+		args:  "-confirm",
+		help:  "Drops all tables and forgets the progress of the passes and the re-sync queue, so the next run loads everything again.",
+		parse: parseDrop,
+	},
+	{
+		name:   "reconcile",
+		args:   "[entity] [-enqueue]",
+		help:   "Compares one or all entities in MongoDB and HANA and prints the differences.",
+		schema: true,
+		parse:  parseReconcile,
+	},
+	{
+		name:   "backfill",
+		args:   "<entity> -ids json | -from json -to json | -filter json",
+		help:   "Loads the selected documents of an entity again.",
+		schema: true,
+		parse:  parseBackfill,
+	},
+	{
+		name:   "dlq",
+		args:   "replay [entity]",
+		help:   "Loads the dead letters of one or all entities again.",
+		schema: true,
+		parse:  parseDLQ,
+	},
+	{
+		name:   "dryrun",
+		args:   "<entity> [-format json|table]",
+		help:   "Prints the changes a pass over an entity would make to HANA without making them.",
+		schema: true,
+		parse:  parseDryRun,
+	},
+	{
+		name:  "inspect",
+		args:  "[entity] [-runs n] [-format table|json]",
+		help:  "Prints the schema version and the progress, the queues and the last runs of one or all entities.",
+		parse: parseInspect,
+	},
+}
+
+// findCommand returns the command name.
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// printUsage writes the usage of the binary, whose flags are fs.
+func printUsage(fs *flag.FlagSet) {
+	out := fs.Output()
+	fmt.Fprintf(out, "usage: %s [flags] [command] [arguments]\n\ncommands:\n", fs.Name())
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %s\n    \t%s\n", strings.TrimSpace(cmd.name+" "+cmd.args), cmd.help)
+	}
+	fmt.Fprintf(out, "\nexit codes:\n"+
+		"  %3d  the command succeeded\n"+
+		"  %3d  the command failed\n"+
+		"  %3d  the arguments or the configuration are invalid\n"+
+		"  %3d  documents failed to load or HANA differs from MongoDB\n"+
+		"  %3d  the command was interrupted by SIGINT or SIGTERM\n",
+		EXIT_OK, EXIT_FAILURE, EXIT_USAGE, EXIT_INCOMPLETE, EXIT_INTERRUPTED)
+	fmt.Fprintf(out, "\nflags, which override the configuration file and the environment:\n")
+	fs.PrintDefaults()
+}
+
+// parseArgs parses the flags of a command, which may follow its positional
+// arguments like in "backfill offers -ids 1,2". It returns the positional
+// arguments, of which there must be at least min and at most max.
+func parseArgs(fs *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	var positional []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		positional, args = append(positional, args[0]), args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	positional = append(positional, fs.Args()...)
+	if len(positional) < min || len(positional) > max {
+		fs.Usage()
+		return nil, fmt.Errorf("expected %d to %d arguments, got %d", min, max, len(positional))
+	}
+	return positional, nil
+}
+
+// entityArg checks the entity name, which may be empty if optional.
+func entityArg(name string, optional bool) error {
+	if name == "" && optional {
+		return nil
+	}
+	for _, entity := range schedulers.EntityNames() {
+		if entity == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown entity %q, expected one of %s", name, strings.Join(schedulers.EntityNames(), ", "))
+}
+
+// entitiesOf returns the entity name, or all entities if it is empty.
+func entitiesOf(name string) []string {
+	if name == "" {
+		return schedulers.EntityNames()
+	}
+	return []string{name}
+}
+
+// formatFlag adds the -format flag of a report to fs.
+func formatFlag(fs *flag.FlagSet, value string) *string {
+	return fs.String("format", value, "the format of the report, json or table")
+}
+
+func checkFormat(format string) error {
+	if format != FORMAT_JSON && format != FORMAT_TABLE {
+		return fmt.Errorf("unknown format %s", format)
+	}
+	return nil
+}
+
+// printJSON writes v to the standard output as indented JSON.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func parseRun(fs *flag.FlagSet, args []string) (action, error) {
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return nil, err
+	}
+	return runService, nil
+}
+
+func parseMigrate(fs *flag.FlagSet, args []string) (action, error) {
+	to := fs.Int("to", -1, "the version migrate down reverts to, one below the current version if it is not set")
+	format := formatFlag(fs, FORMAT_TABLE)
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkFormat(*format); err != nil {
+		return nil, err
+	}
+
+	switch positional[0] {
+	case "up":
+		return func(ctx context.Context, a *app) error {
+			if err := hana.Migrate(ctx, a.hanaDB); err != nil {
+				return err
+			}
+			a.lg.Info("migrated tables", zap.Int("version", hana.LatestVersion()))
+			return nil
+		}, nil
+	case "down":
+		return func(ctx context.Context, a *app) error {
+			current, err := hana.SchemaVersion(ctx, a.hanaDB)
+			if err != nil {
+				return err
+			}
+			version := *to
+			if version < 0 {
+				version = current - 1
+			}
+			// reverting the first migration drops the tables along with
+			// their data, which is what drop is for
+			if version < 1 {
+				return usageError("migrate down keeps version 1, use drop -confirm to drop all tables")
+			}
+			if err = hana.Rollback(ctx, a.hanaDB, version); err != nil {
+				return err
+			}
+			a.lg.Info("reverted migrations", zap.Int("from", current), zap.Int("version", version))
+			return nil
+		}, nil
+	case "status":
+		return func(ctx context.Context, a *app) error {
+			states, err := hana.MigrationStates(ctx, a.hanaDB)
+			if err != nil {
+				return err
+			}
+			if *format == FORMAT_JSON {
+				return printJSON(states)
+			}
+			return printMigrations(os.Stdout, states)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown migrate command %s", positional[0])
+	}
+}
+
+// extJSONValue parses a single value in extended JSON, e.g. 42, "a" or
+// {"$oid": "..."}.
+func extJSONValue(s string) (interface{}, error) {
+	var doc bson.M
+	if err := bson.UnmarshalExtJSON([]byte(`{"v": `+s+`}`), false, &doc); err != nil {
+		return nil, err
+	}
+	return doc["v"], nil
+}
+
+// printMigrations writes a table of the migrations.
+func printMigrations(out io.Writer, states []hana.MigrationState) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "VERSION\tNAME\tAPPLIED AT\n")
+	for _, s := range states {
+		appliedAt := "pending"
+		if s.Applied {
+			appliedAt = s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+	}
+	return w.Flush()
+}
+
+func parseSync(fs *flag.FlagSet, args []string) (action, error) {
+	entity := fs.String("entity", "", "the entity to load, all entities if it is not set")
+	once := fs.Bool("once", false, "run a single pass and exit instead of loading continuously")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return nil, err
+	}
+	if err := entityArg(*entity, true); err != nil {
+		return nil, err
+	}
+
+	if *once {
+		return func(ctx context.Context, a *app) error {
+			// dependencies are loaded first, like by the coordinator
+			order, err := schedulers.LoadOrder(schedulers.Dependencies, entitiesOf(*entity))
+			if err != nil {
+				return err
+			}
+			var failed int64
+			for _, name := range order {
+				run, err := schedulers.Sync(ctx, a.mongoDB, a.hanaDB, a.schedulerConfig(name, nil, nil, nil, nil), name)
+				if run != nil {
+					failed += run.Failed
+					if perr := printJSON(run); perr != nil {
+						return perr
+					}
+				}
+				if err != nil {
+					return fmt.Errorf("failed to sync %s: %v", name, err)
+				}
+			}
+			if failed > 0 {
+				return incompleteError("%d documents failed to load", failed)
+			}
+			return nil
+		}, nil
+	}
+
+	return func(ctx context.Context, a *app) error {
+		// the coordinator orders dependent entities only if they all run
+		var coordinator *schedulers.Coordinator
+		if *entity == "" {
+			var err error
+			if coordinator, err = schedulers.NewCoordinator(schedulers.Dependencies); err != nil {
+				return err
+			}
+		}
+		sv := supervisor.New(a.lg, a.reg, a.restartPolicy())
+		for _, name := range entitiesOf(*entity) {
+			name, cfg := name, a.schedulerConfig(name, nil, nil, coordinator, nil)
+			sv.Add(name, func(ctx context.Context) error {
+				return schedulers.Run(ctx, a.mongoDB, a.hanaDB, cfg, name)
+			})
+		}
+		sv.Run(ctx)
+		return nil
+	}, nil
+}
+
+func parseDrop(fs *flag.FlagSet, args []string) (action, error) {
+	confirm := fs.Bool("confirm", false, "confirm that all tables are dropped along with their data")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return nil, err
+	}
+	if !*confirm {
+		return nil, errors.New("drop deletes all tables and their data, pass -confirm to proceed")
+	}
+
+	return func(ctx context.Context, a *app) error {
+		if err := hana.Rollback(ctx, a.hanaDB, 0); err != nil {
+			return err
+		}
+		a.lg.Info("dropped tables")
+		// the checkpoints would resume passes over the dropped tables
+		for _, name := range schedulers.EntityNames() {
+			if err := a.mongoDB.DeleteCheckpoint(ctx, name); err != nil {
+				return fmt.Errorf("failed to delete checkpoint of %s: %v", name, err)
+			}
+		}
+		a.lg.Info("deleted checkpoints")
+		// the queued documents would be loaded into the new tables ahead of
+		// the first pass
+		if err := a.mongoDB.ClearResync(ctx); err != nil {
+			return fmt.Errorf("failed to clear the re-sync queue: %v", err)
+		}
+		a.lg.Info("cleared re-sync queue")
+		return nil
+	}, nil
+}
+
+func parseReconcile(fs *flag.FlagSet, args []string) (action, error) {
+	enqueue := fs.Bool("enqueue", false, "queue the missing and different documents for re-sync")
+	positional, err := parseArgs(fs, args, 0, 1)
+	if err != nil {
+		return nil, err
+	}
+	var entity string
+	if len(positional) == 1 {
+		entity = positional[0]
+	}
+	if err = entityArg(entity, true); err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context, a *app) error {
+		rc := a.reconcileConfig()
+		rc.Enqueue = rc.Enqueue || *enqueue
+		cfg := a.schedulerConfig(config.PIPELINE_RECONCILE, nil, nil, nil, nil)
+		var differences int
+		for _, name := range entitiesOf(entity) {
+			report, err := schedulers.Reconcile(ctx, a.mongoDB, a.hanaDB, cfg, rc, name)
+			if err != nil {
+				return err
+			}
+			if err = printJSON(report); err != nil {
+				return err
+			}
+			differences += report.MissingCount + report.ExtraCount + report.DifferentCount
+		}
+		if differences > 0 {
+			return incompleteError("%d documents differ between MongoDB and HANA", differences)
+		}
+		return nil
+	}, nil
+}
+
+func parseBackfill(fs *flag.FlagSet, args []string) (action, error) {
+	ids := fs.String("ids", "", `the _ids of the documents as an extended JSON array, e.g. [1, "a", {"$oid": "..."}]`)
+	from := fs.String("from", "", "the first _id of the range in extended JSON")
+	to := fs.String("to", "", "the _id after the range in extended JSON")
+	filter := fs.String("filter", "", "a MongoDB query document in extended JSON")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	if err = entityArg(positional[0], false); err != nil {
+		return nil, err
+	}
+
+	// the _ids are typed like in MongoDB, so numbers and ObjectIds match
+	b := schedulers.Backfill{Entity: positional[0]}
+	if *ids != "" {
+		v, err := extJSONValue(*ids)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ids: %v", err)
+		}
+		list, ok := v.(primitive.A)
+		if !ok {
+			return nil, fmt.Errorf("invalid ids: %s is not an array", *ids)
+		}
+		b.IDs = list
+	}
+	if *from != "" {
+		if b.From, err = extJSONValue(*from); err != nil {
+			return nil, fmt.Errorf("invalid from: %v", err)
+		}
+	}
+	if *to != "" {
+		if b.To, err = extJSONValue(*to); err != nil {
+			return nil, fmt.Errorf("invalid to: %v", err)
+		}
+	}
+	if *filter != "" {
+		var query bson.M
+		if err = bson.UnmarshalExtJSON([]byte(*filter), false, &query); err != nil {
+			return nil, fmt.Errorf("invalid filter: %v", err)
+		}
+		b.Filter = query
+	}
+	if err = b.Validate(); err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context, a *app) error {
+		report, err := schedulers.RunBackfill(ctx, a.mongoDB, a.hanaDB,
+			a.schedulerConfig(config.PIPELINE_BACKFILL, nil, nil, nil, nil), b)
+		if report != nil {
+			if perr := printJSON(report); perr != nil {
+				return perr
+			}
+			if err == nil && report.Failed > 0 {
+				return incompleteError("%d documents failed to load", report.Failed)
+			}
+			// an _id of the wrong type matches nothing
+			if err == nil && len(b.IDs) > 0 && report.Read == 0 {
+				return incompleteError("none of the %d ids matched a document", len(b.IDs))
+			}
+		}
+		return err
+	}, nil
+}
+
+func parseDLQ(fs *flag.FlagSet, args []string) (action, error) {
+	positional, err := parseArgs(fs, args, 1, 2)
+	if err != nil {
+		return nil, err
+	}
+	if positional[0] != "replay" {
+		return nil, fmt.Errorf("unknown dlq command %s", positional[0])
+	}
+	var entity string
+	if len(positional) == 2 {
+		entity = positional[1]
+	}
+	if err = entityArg(entity, true); err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context, a *app) error {
+		replayed, failed, err := schedulers.ReplayDeadLetters(ctx, a.mongoDB, a.hanaDB,
+			a.schedulerConfig(config.PIPELINE_DLQ, nil, nil, nil, nil), entity)
+		a.lg.Info("replayed dead letters", zap.Int("replayed", replayed), zap.Int("failed", failed))
+		if err == nil && failed > 0 {
+			return incompleteError("%d dead letters failed to load again", failed)
+		}
+		return err
+	}, nil
+}
+
+func parseDryRun(fs *flag.FlagSet, args []string) (action, error) {
+	format := formatFlag(fs, FORMAT_JSON)
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	if err = entityArg(positional[0], false); err != nil {
+		return nil, err
+	}
+	if err = checkFormat(*format); err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context, a *app) error {
+		report, err := schedulers.DryRun(ctx, a.mongoDB, a.hanaDB,
+			a.schedulerConfig(config.PIPELINE_DRYRUN, nil, nil, nil, nil), positional[0])
+		if err != nil {
+			return err
+		}
+		if *format == FORMAT_JSON {
+			return printJSON(report)
+		}
+		return printDiff(os.Stdout, report)
+	}, nil
+}
+
+// printDiff writes a table summary of a dry run: the counts followed by the
+// changed columns of the listed updates.
+func printDiff(out io.Writer, report *schedulers.DiffReport) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ENTITY\tREAD\tINVALID\tUNCHANGED\tINSERTS\tUPDATES\tORPHANS\n")
+	fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\n", report.Entity, report.Read, report.Invalid, report.Unchanged,
+		report.InsertCount, report.UpdateCount, report.OrphanCount)
+	if len(report.Updates) > 0 {
+		fmt.Fprintf(w, "\nID\tCOLUMN\tBEFORE\tAFTER\n")
+		for _, u := range report.Updates {
+			for _, c := range u.Columns {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", u.ID, c.Column, c.Before, c.After)
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// inspection is the state of the schema and of the entities.
+type inspection struct {
+	SchemaVersion int                `json:"schemaVersion"`
+	LatestVersion int                `json:"latestVersion"`
+	Entities      []entityInspection `json:"entities"`
+}
+
+type entityInspection struct {
+	Entity string `json:"entity"`
+	// Pass is the current or last pass, 0 if none was started.
+	Pass           int64 `json:"pass"`
+	Partitions     int   `json:"partitions"`
+	PartitionsDone int   `json:"partitionsDone"`
+	// Queued is the number of documents queued for re-sync.
+	Queued      int64       `json:"queued"`
+	DeadLetters int64       `json:"deadLetters"`
+	Runs        []*hana.Run `json:"runs"`
+}
+
+func parseInspect(fs *flag.FlagSet, args []string) (action, error) {
+	runs := fs.Int("runs", 5, "the number of runs listed per entity")
+	format := formatFlag(fs, FORMAT_TABLE)
+	positional, err := parseArgs(fs, args, 0, 1)
+	if err != nil {
+		return nil, err
+	}
+	var entity string
+	if len(positional) == 1 {
+		entity = positional[0]
+	}
+	if err = entityArg(entity, true); err != nil {
+		return nil, err
+	}
+	if err = checkFormat(*format); err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context, a *app) error {
+		version, err := hana.SchemaVersion(ctx, a.hanaDB)
+		if err != nil {
+			return err
+		}
+		if version < hana.LatestVersion() {
+			return fmt.Errorf("schema version %d is older than %d, run migrate up first", version, hana.LatestVersion())
+		}
+
+		report := inspection{SchemaVersion: version, LatestVersion: hana.LatestVersion()}
+		for _, name := range entitiesOf(entity) {
+			ei := entityInspection{Entity: name}
+			cp, err := a.mongoDB.GetCheckpoint(ctx, name)
+			if err != nil {
+				return fmt.Errorf("failed to get checkpoint of %s: %v", name, err)
+			}
+			if cp != nil {
+				ei.Pass = cp.Pass
+				ei.Partitions = len(cp.Partitions)
+				for _, p := range cp.Partitions {
+					if p.Done {
+						ei.PartitionsDone++
+					}
+				}
+			}
+			if ei.Queued, err = a.mongoDB.CountResync(ctx, name); err != nil {
+				return fmt.Errorf("failed to count documents of %s queued for re-sync: %v", name, err)
+			}
+			if ei.DeadLetters, err = hana.CountDeadLetters(ctx, a.hanaDB, name); err != nil {
+				return err
+			}
+			if ei.Runs, err = hana.GetRuns(ctx, a.hanaDB, name, *runs); err != nil {
+				return err
+			}
+			report.Entities = append(report.Entities, ei)
+		}
+
+		if *format == FORMAT_JSON {
+			return printJSON(report)
+		}
+		return printInspection(os.Stdout, report)
+	}, nil
+}
+
+// printInspection writes the state of every entity followed by its last runs.
+func printInspection(out io.Writer, report inspection) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "SCHEMA VERSION\t%d of %d\n\n", report.SchemaVersion, report.LatestVersion)
+	fmt.Fprintf(w, "ENTITY\tPASS\tPARTITIONS DONE\tQUEUED\tDEAD LETTERS\n")
+	for _, ei := range report.Entities {
+		fmt.Fprintf(w, "%s\t%d\t%d/%d\t%d\t%d\n", ei.Entity, ei.Pass, ei.PartitionsDone, ei.Partitions,
+			ei.Queued, ei.DeadLetters)
+	}
+	fmt.Fprintf(w, "\nENTITY\tRUN\tMODE\tPASS\tSTATUS\tSTARTED AT\tDURATION\tREAD\tINSERTED\tUPDATED\tSKIPPED\tFAILED\n")
+	for _, ei := range report.Entities {
+		for _, run := range ei.Runs {
+			duration := "-"
+			if !run.FinishedAt.IsZero() {
+				duration = run.FinishedAt.Sub(run.StartedAt).Round(time.Second).String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\n", run.Entity, run.ID, run.Mode, run.Pass,
+				run.Status, run.StartedAt.Format(time.RFC3339), duration, run.Read, run.Inserted, run.Updated,
+				run.Skipped, run.Failed)
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func newFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("go-hana test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		min     int
+		max     int
+		want    []string
+		wantErr bool
+	}{
+		{name: "flags after arguments", args: []string{"offers", "-enqueue"}, min: 0, max: 1, want: []string{"offers"}},
+		{name: "flags before arguments", args: []string{"-enqueue", "offers"}, min: 0, max: 1, want: []string{"offers"}},
+		{name: "none", args: nil, min: 0, max: 1, want: nil},
+		{name: "too few", args: []string{"-enqueue"}, min: 1, max: 1, wantErr: true},
+		{name: "too many", args: []string{"offers", "shops"}, min: 0, max: 1, wantErr: true},
+		{name: "unknown flag", args: []string{"offers", "-force"}, min: 0, max: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newFlagSet()
+			enqueue := fs.Bool("enqueue", false, "")
+			got, err := parseArgs(fs, tt.args, tt.min, tt.max)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseArgs() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseArgs() = %q, want %q", got, tt.want)
+			}
+			if len(tt.args) > 0 && !*enqueue {
+				t.Error("-enqueue was not parsed")
+			}
+		})
+	}
+}
+
+func TestEntityArg(t *testing.T) {
+	if err := entityArg("offers", false); err != nil {
+		t.Errorf("entityArg(offers) = %v", err)
+	}
+	if err := entityArg("", true); err != nil {
+		t.Errorf("entityArg() of an optional entity = %v", err)
+	}
+	if err := entityArg("", false); err == nil {
+		t.Error("entityArg() accepted a missing entity")
+	}
+	if err := entityArg("users", true); err == nil {
+		t.Error("entityArg(users) accepted an unknown entity")
+	}
+}
+
+func TestExtJSONValue(t *testing.T) {
+	oid, err := primitive.ObjectIDFromHex("5f1b0c3e9d1e8a2b3c4d5e6f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		s       string
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "integer", s: "42", want: int32(42)},
+		{name: "long", s: `{"$numberLong": "42"}`, want: int64(42)},
+		{name: "string", s: `"a"`, want: "a"},
+		{name: "object id", s: `{"$oid": "5f1b0c3e9d1e8a2b3c4d5e6f"}`, want: oid},
+		{name: "array", s: `[1, "a"]`, want: primitive.A{int32(1), "a"}},
+		{name: "bare string", s: "a", wantErr: true},
+		{name: "invalid object id", s: `{"$oid": "nope"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extJSONValue(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extJSONValue(%s) error = %v, want error %v", tt.s, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extJSONValue(%s) = %#v, want %#v", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBackfill(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{name: "ids", args: []string{"offers", "-ids", `[1, {"$oid": "5f1b0c3e9d1e8a2b3c4d5e6f"}]`}},
+		{name: "range", args: []string{"offers", "-from", "1", "-to", "100"}},
+		{name: "filter", args: []string{"offers", "-filter", `{"shopId": 1}`}},
+		{name: "ids not an array", args: []string{"offers", "-ids", "1"}, wantErr: true},
+		{name: "comma separated ids", args: []string{"offers", "-ids", "1,2"}, wantErr: true},
+		{name: "bare string bound", args: []string{"offers", "-from", "a"}, wantErr: true},
+		{name: "two selectors", args: []string{"offers", "-ids", "[1]", "-from", "1"}, wantErr: true},
+		{name: "no selector", args: []string{"offers"}, wantErr: true},
+		{name: "unknown entity", args: []string{"users", "-ids", "[1]"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseBackfill(newFlagSet(), tt.args); (err != nil) != tt.wantErr {
+				t.Errorf("parseBackfill() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
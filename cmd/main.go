@@ -2,104 +2,314 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go-hana/internal/config"
 	"go-hana/internal/hana"
 	"go-hana/internal/mongodb"
 	"go-hana/internal/schedulers"
+	"go-hana/internal/supervisor"
+	"go-hana/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+const (
+	// exit codes, the same for every command
+	EXIT_OK = 0
+	// the command failed
+	EXIT_FAILURE = 1
+	// the arguments or the configuration are invalid
+	EXIT_USAGE = 2
+	// the command finished, but documents failed to load or HANA differs
+	// from MongoDB
+	EXIT_INCOMPLETE = 3
+	// the command was stopped by SIGINT or SIGTERM before it finished
+	EXIT_INTERRUPTED = 130
+)
+
+// app is what every command shares: the configuration, the logs, the traces,
+// the metrics and the connections.
+type app struct {
+	cfg     *config.Config
+	lg      *zap.Logger
+	tp      trace.TracerProvider
+	reg     *prometheus.Registry
+	mongoDB *mongodb.DB
+	hanaDB  *hana.DB
+}
+
+// exitError is an error that ends the command with code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+
+// usageError returns an error for invalid arguments.
+func usageError(format string, args ...interface{}) error {
+	return &exitError{code: EXIT_USAGE, err: fmt.Errorf(format, args...)}
+}
+
+// incompleteError returns an error for a command that finished with failed
+// documents or differences.
+func incompleteError(format string, args ...interface{}) error {
+	return &exitError{code: EXIT_INCOMPLETE, err: fmt.Errorf(format, args...)}
+}
+
 func main() {
-	lg, err := zap.NewProduction()
+	os.Exit(execute(os.Args[0], os.Args[1:]))
+}
+
+// execute loads the configuration, runs the command of args and returns the
+// exit code. Without a command, the schedulers are run as a service.
+func execute(name string, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		printUsage(fs)
+	}
+	cfg, err := config.Load(fs, args)
+	if err == flag.ErrHelp {
+		return EXIT_OK
+	}
 	if err != nil {
-		log.Fatalf("can't initialize zap logger: %v", err)
+		log.Printf("error while loading configuration: %v", err)
+		return EXIT_USAGE
+	}
+
+	args = fs.Args()
+	cmdName := "run"
+	if len(args) > 0 {
+		cmdName, args = args[0], args[1:]
+	}
+	cmd, ok := findCommand(cmdName)
+	if !ok {
+		log.Printf("unknown command %s, see %s -help", cmdName, name)
+		return EXIT_USAGE
+	}
+	cmdFlags := flag.NewFlagSet(name+" "+cmd.name, flag.ContinueOnError)
+	cmdFlags.Usage = func() {
+		fmt.Fprintf(cmdFlags.Output(), "usage: %s [flags] %s %s\n\n%s\n", name, cmd.name, cmd.args, cmd.help)
+		cmdFlags.PrintDefaults()
+	}
+	act, err := cmd.parse(cmdFlags, args)
+	if err == flag.ErrHelp {
+		return EXIT_OK
+	}
+	if err != nil {
+		log.Printf("%s: %v", cmd.name, err)
+		return EXIT_USAGE
+	}
+
+	lg, err := newLogger(cfg.Log)
+	if err != nil {
+		log.Printf("can't initialize zap logger: %v", err)
+		return EXIT_USAGE
 	}
 	defer lg.Sync()
+	lg = lg.With(zap.String("command", cmd.name))
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// cancelled on SIGINT/SIGTERM, which stops the extraction
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	mongoDB, err := mongodb.NewMongoDB(ctx, mongodb.Config{
-		URI: os.Getenv("MONGO_URI"),
+	// spans of the runs, pages, documents and database calls, exported to a
+	// local OTLP collector or printed for development
+	tp, shutdownTracing, err := tracing.New(ctx, tracing.Config{
+		Exporter:    cfg.Tracing.Exporter,
+		Endpoint:    cfg.Tracing.Endpoint,
+		Insecure:    cfg.Tracing.Insecure,
+		SampleRatio: cfg.Tracing.SampleRatio,
+		ServiceName: cfg.Tracing.ServiceName,
 	})
 	if err != nil {
-		lg.Fatal("error while connecting to MongoDB", zap.Error(err))
-		return
+		lg.Error("error while setting up tracing", zap.Error(err))
+		return EXIT_FAILURE
 	}
-	lg.Info("connected to MongoDB")
+	defer func() {
+		// the spans still buffered are flushed
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			lg.Error("error while stopping tracing", zap.Error(err))
+		}
+	}()
 
-	hanaUri := fmt.Sprintf("hdb://%s:%s@%s:%s?TLSServerName=%s&TLSRootCAFile=DigiCertGlobalRootCA.crt.pem",
-		os.Getenv("HANA_USER"),
-		os.Getenv("HANA_PASSWORD"),
-		os.Getenv("HANA_HOST"),
-		os.Getenv("HANA_PORT"),
-		os.Getenv("HANA_HOST"),
-	)
+	a, err := connect(ctx, cfg, lg, tp)
+	if err != nil {
+		lg.Error("error while connecting", zap.Error(err))
+		return exitCode(ctx, err)
+	}
+	defer a.close()
 
-	hanaDB, err := hana.NewHanaDB(hanaUri)
+	// the schema is migrated by migrate up once per release, not by every
+	// replica that starts
+	if cmd.schema {
+		if err = checkSchema(ctx, a.hanaDB); err != nil {
+			lg.Error("error while checking schema", zap.Error(err))
+			return exitCode(ctx, err)
+		}
+	}
+
+	if err = act(ctx, a); err != nil {
+		lg.Error("error while running command", zap.Strings("args", args), zap.Error(err))
+	}
+	return exitCode(ctx, err)
+}
+
+// exitCode returns the exit code of a command that returned err.
+func exitCode(ctx context.Context, err error) int {
+	var exitErr *exitError
+	switch {
+	case err == nil:
+		return EXIT_OK
+	case errors.As(err, &exitErr):
+		return exitErr.code
+	case ctx.Err() != nil:
+		return EXIT_INTERRUPTED
+	default:
+		return EXIT_FAILURE
+	}
+}
+
+// checkSchema fails unless the schema is at the version of this build.
+func checkSchema(ctx context.Context, hanaDB *hana.DB) error {
+	version, err := hana.SchemaVersion(ctx, hanaDB)
+	if err != nil {
+		return err
+	}
+	if latest := hana.LatestVersion(); version < latest {
+		return fmt.Errorf("schema is at version %d, expected %d, run migrate up first", version, latest)
+	} else if version > latest {
+		return fmt.Errorf("schema is at version %d, expected %d, it was migrated by a newer build", version, latest)
+	}
+	return nil
+}
+
+// connect sets up the metrics and connects to MongoDB and HANA.
+func connect(ctx context.Context, cfg *config.Config, lg *zap.Logger, tp trace.TracerProvider) (*app, error) {
+	// every metric is registered here, along with the Go runtime and process
+	// metrics
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	mongoDB, err := mongodb.NewMongoDB(ctx, reg, mongodb.Config{
+		URI:             cfg.Mongo.URI,
+		MaxPoolSize:     uint64(cfg.Mongo.MaxPoolSize),
+		MinPoolSize:     uint64(cfg.Mongo.MinPoolSize),
+		MaxConnIdleTime: cfg.Mongo.MaxConnIdleTime,
+		TracerProvider:  tp,
+	})
 	if err != nil {
-		lg.Fatal("error while connecting to HANA", zap.Error(err))
-		return
+		return nil, fmt.Errorf("failed to connect to MongoDB: %v", err)
+	}
+	lg.Info("connected to MongoDB")
+
+	hanaDB, err := hana.NewHanaDB(ctx, reg, hana.Config{
+		URI:          cfg.Hana.URI(),
+		MaxOpenConns: cfg.Hana.MaxOpenConns,
+		// every worker keeps its connection between documents
+		MaxIdleConns:    cfg.Hana.MaxIdleConns,
+		ConnMaxLifetime: cfg.Hana.ConnMaxLifetime,
+		ConnMaxIdleTime: cfg.Hana.ConnMaxIdleTime,
+		TracerProvider:  tp,
+	})
+	if err != nil {
+		_ = mongoDB.Disconnect(context.Background())
+		return nil, fmt.Errorf("failed to connect to HANA: %v", err)
 	}
 	lg.Info("connected to HANA")
 
-	// run if needed
-	//if err = hana.DropTables(hanaDB); err != nil {
-	//	lg.Fatal("error while dropping tables", zap.Error(err))
-	//	return
-	//}
-	//lg.Info("dropped tables")
-	if err = hana.CreateTables(hanaDB); err != nil {
-		lg.Fatal("error while creating tables", zap.Error(err))
-		return
-	}
-	lg.Info("created tables")
-
-	// metrics server
-	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-		if err = http.ListenAndServe(":9090", nil); err != nil {
-			lg.Fatal("error while starting metrics server", zap.Error(err))
-			return
-		}
-	}()
+	return &app{cfg: cfg, lg: lg, tp: tp, reg: reg, mongoDB: mongoDB, hanaDB: hanaDB}, nil
+}
 
-	// ETL from MongoDB to HANA
-	go func() {
-		if err = schedulers.NewOfferScheduler(ctx, mongoDB, hanaDB); err != nil {
-			lg.Fatal("error while starting offer scheduler", zap.Error(err))
-			return
-		}
-	}()
-	go func() {
-		if err = schedulers.NewProductScheduler(ctx, mongoDB, hanaDB); err != nil {
-			lg.Fatal("error while starting product scheduler", zap.Error(err))
-			return
-		}
-	}()
-	go func() {
-		if err = schedulers.NewShopScheduler(ctx, mongoDB, hanaDB); err != nil {
-			lg.Fatal("error while starting shop scheduler", zap.Error(err))
-			return
-		}
-	}()
-	go func() {
-		if err = schedulers.NewShopReviewScheduler(ctx, mongoDB, hanaDB); err != nil {
-			lg.Fatal("error while starting shop review scheduler", zap.Error(err))
-			return
-		}
-	}()
+// close disconnects from MongoDB and HANA.
+func (a *app) close() {
+	// the command context may be cancelled by now, so the shutdown gets a
+	// context of its own
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := a.mongoDB.Disconnect(ctx); err != nil {
+		a.lg.Error("error while disconnecting from MongoDB", zap.Error(err))
+	}
+	if err := a.hanaDB.Close(); err != nil {
+		a.lg.Error("error while disconnecting from HANA", zap.Error(err))
+	}
+}
 
-	<-ctx.Done()
-	if err = mongoDB.Disconnect(ctx); err != nil {
-		lg.Fatal("error while disconnecting from MongoDB", zap.Error(err))
+// schedulerConfig returns the settings of the pipeline name, an entity or one
+// of the config.PIPELINE_* jobs.
+func (a *app) schedulerConfig(name string, metrics *schedulers.Metrics, assignment schedulers.Assignment,
+	coordinator *schedulers.Coordinator, breaker schedulers.Breaker) schedulers.Config {
+	pipeline := a.cfg.Pipeline(name)
+	return schedulers.Config{
+		Logger:         a.lg,
+		Metrics:        metrics,
+		TracerProvider: a.tp,
+		Breaker:        breaker,
+		Assignment:     assignment,
+		Coordinator:    coordinator,
+		Workers:        pipeline.Workers,
+		Partitions:     pipeline.Partitions,
+		PageSize:       a.cfg.Loading.PageSize,
+		GracePeriod:    a.cfg.Loading.GracePeriod,
+		PassInterval:   pipeline.PassInterval,
+		Retry: schedulers.Retry{
+			Attempts:   a.cfg.Loading.Retry.Attempts,
+			Backoff:    a.cfg.Loading.Retry.Backoff,
+			MaxBackoff: a.cfg.Loading.Retry.MaxBackoff,
+		},
+		Timeouts: schedulers.Timeouts{
+			Read:       a.cfg.Loading.Timeouts.Read,
+			Write:      a.cfg.Loading.Timeouts.Write,
+			Checkpoint: a.cfg.Loading.Timeouts.Checkpoint,
+		},
 	}
-	if err = hanaDB.Close(); err != nil {
-		lg.Fatal("error while disconnecting from HANA", zap.Error(err))
+}
+
+// reconcileConfig returns the settings of the reconciliation. The scheduled
+// reconciliation is disabled unless reconcile.interval is set.
+func (a *app) reconcileConfig() schedulers.ReconcileConfig {
+	return schedulers.ReconcileConfig{
+		Interval: a.cfg.Reconcile.Interval,
+		Buckets:  a.cfg.Reconcile.Buckets,
+		Enqueue:  a.cfg.Reconcile.Enqueue,
+	}
+}
+
+// restartPolicy returns the policy of the supervisor.
+func (a *app) restartPolicy() supervisor.Policy {
+	return supervisor.Policy{
+		InitialBackoff: a.cfg.Restart.InitialBackoff,
+		MaxBackoff:     a.cfg.Restart.MaxBackoff,
+		Jitter:         a.cfg.Restart.Jitter,
+		MaxRestarts:    a.cfg.Restart.MaxRestarts,
+		Window:         a.cfg.Restart.Window,
+	}
+}
+
+// newLogger returns the production logger with the level and the sampling
+// of cfg.
+func newLogger(cfg config.Log) (*zap.Logger, error) {
+	zcfg := zap.NewProductionConfig()
+	if err := zcfg.Level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level: %v", err)
+	}
+	zcfg.Sampling = nil
+	if cfg.SamplingInitial > 0 {
+		zcfg.Sampling = &zap.SamplingConfig{
+			Initial:    cfg.SamplingInitial,
+			Thereafter: cfg.SamplingThereafter,
+		}
 	}
-	lg.Info("main finished")
+	return zcfg.Build()
 }
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want int
+	}{
+		{name: "success", ctx: context.Background(), err: nil, want: EXIT_OK},
+		{name: "failure", ctx: context.Background(), err: errors.New("connection refused"), want: EXIT_FAILURE},
+		{name: "usage", ctx: context.Background(), err: usageError("unknown entity"), want: EXIT_USAGE},
+		{
+			name: "wrapped incomplete",
+			ctx:  context.Background(),
+			err:  fmt.Errorf("backfill: %w", incompleteError("3 documents failed to load")),
+			want: EXIT_INCOMPLETE,
+		},
+		{name: "interrupted", ctx: cancelled, err: context.Canceled, want: EXIT_INTERRUPTED},
+		{name: "interrupted with success", ctx: cancelled, err: nil, want: EXIT_OK},
+		// failed documents are reported even if the command was interrupted
+		{name: "incomplete when interrupted", ctx: cancelled, err: incompleteError("differences"), want: EXIT_INCOMPLETE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.ctx, tt.err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
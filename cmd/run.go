@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go-hana/internal/admin"
+	"go-hana/internal/cluster"
+	"go-hana/internal/config"
+	"go-hana/internal/health"
+	"go-hana/internal/leader"
+	"go-hana/internal/schedulers"
+	"go-hana/internal/supervisor"
+	"go-hana/internal/watchdog"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+// runService runs the schedulers of all entities along with the metrics, the
+// probes and the admin API until ctx is cancelled.
+func runService(ctx context.Context, a *app) error {
+	cfg, lg := a.cfg, a.lg
+	metrics := schedulers.NewMetrics(a.reg)
+
+	// pauses the pipelines while HANA or MongoDB is unavailable
+	wd := watchdog.New(lg, a.reg, a.mongoDB, a.hanaDB, watchdog.Config{
+		Interval:         cfg.Watchdog.Interval,
+		Timeout:          cfg.Watchdog.Timeout,
+		FailureThreshold: cfg.Watchdog.FailureThreshold,
+	})
+	go wd.Run(ctx)
+
+	// in leader mode, only the replica holding the lease runs the schedulers
+	var elector *leader.Elector
+	if cfg.Cluster.Mode == config.CLUSTER_MODE_LEADER {
+		elector = leader.New(lg, a.reg, a.mongoDB, a.hanaDB, leader.Config{
+			Name:          "go-hana",
+			Identity:      cfg.Cluster.Identity,
+			LeaseDuration: cfg.Cluster.LeaseDuration,
+			RenewInterval: cfg.Cluster.RenewInterval,
+		})
+	}
+
+	// pipelines can be controlled through the admin API if a token is set,
+	// on a listener of its own or next to the metrics
+	controls := schedulers.NewControls(lg)
+	mux := http.NewServeMux()
+	var adminServer *http.Server
+	if cfg.Admin.Token != "" {
+		adminConfig := admin.Config{
+			Token:    cfg.Admin.Token,
+			Backfill: a.schedulerConfig(config.PIPELINE_BACKFILL, metrics, nil, nil, wd),
+		}
+		// backfills are fenced like the schedulers, so a standby rejects them
+		if elector != nil {
+			adminConfig.Leader = elector
+		}
+		handler := admin.New(ctx, lg, a.mongoDB, a.hanaDB, controls, adminConfig)
+		if cfg.Admin.Addr == "" {
+			mux.Handle("/admin/", handler)
+		} else {
+			adminMux := http.NewServeMux()
+			adminMux.Handle("/admin/", handler)
+			adminServer = &http.Server{Addr: cfg.Admin.Addr, Handler: adminMux}
+			go func() {
+				if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					lg.Fatal("error while starting admin server", zap.Error(err))
+					return
+				}
+			}()
+		}
+	} else {
+		lg.Info("admin API is disabled, admin.token is not set")
+	}
+
+	// liveness and readiness probes
+	checker := health.New(a.mongoDB, a.hanaDB, controls, wd, health.Config{
+		Timeout:   cfg.Health.Timeout,
+		Staleness: cfg.Health.Staleness,
+	})
+	mux.Handle("/healthz", checker.Liveness())
+	mux.Handle("/readyz", checker.Readiness())
+
+	// metrics server
+	mux.Handle("/metrics", promhttp.HandlerFor(a.reg, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: cfg.Metrics.Addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			lg.Fatal("error while starting metrics server", zap.Error(err))
+			return
+		}
+	}()
+
+	// replicas either stand by for the leader or share the work
+	var assignment schedulers.Assignment
+	membershipDone := make(chan struct{})
+	switch cfg.Cluster.Mode {
+	case config.CLUSTER_MODE_SINGLE, config.CLUSTER_MODE_LEADER:
+		close(membershipDone)
+	case config.CLUSTER_MODE_PARTITIONED:
+		membership := cluster.New(lg, a.reg, a.mongoDB, cluster.Config{
+			Identity:          cfg.Cluster.Identity,
+			HeartbeatInterval: cfg.Cluster.HeartbeatInterval,
+			MemberTTL:         cfg.Cluster.MemberTTL,
+			VirtualNodes:      cfg.Cluster.VirtualNodes,
+		})
+		go func() {
+			defer close(membershipDone)
+			membership.Run(ctx)
+		}()
+		assignment = membership
+	}
+
+	// ETL from MongoDB to HANA
+	sv := supervisor.New(lg, a.reg, a.restartPolicy())
+	coordinator, err := schedulers.NewCoordinator(schedulers.Dependencies)
+	if err != nil {
+		return err
+	}
+	shopConfig := a.schedulerConfig(schedulers.SHOPS, metrics, assignment, coordinator, wd)
+	shopConfig.Control = controls[schedulers.SHOPS]
+	sv.Add(schedulers.SHOPS, func(ctx context.Context) error {
+		return schedulers.NewShopScheduler(ctx, a.mongoDB, a.hanaDB, shopConfig)
+	})
+	productConfig := a.schedulerConfig(schedulers.PRODUCTS, metrics, assignment, coordinator, wd)
+	productConfig.Control = controls[schedulers.PRODUCTS]
+	sv.Add(schedulers.PRODUCTS, func(ctx context.Context) error {
+		return schedulers.NewProductScheduler(ctx, a.mongoDB, a.hanaDB, productConfig)
+	})
+	offerConfig := a.schedulerConfig(schedulers.OFFERS, metrics, assignment, coordinator, wd)
+	offerConfig.Control = controls[schedulers.OFFERS]
+	sv.Add(schedulers.OFFERS, func(ctx context.Context) error {
+		return schedulers.NewOfferScheduler(ctx, a.mongoDB, a.hanaDB, offerConfig)
+	})
+	shopReviewConfig := a.schedulerConfig(schedulers.SHOP_REVIEWS, metrics, assignment, coordinator, wd)
+	shopReviewConfig.Control = controls[schedulers.SHOP_REVIEWS]
+	sv.Add(schedulers.SHOP_REVIEWS, func(ctx context.Context) error {
+		return schedulers.NewShopReviewScheduler(ctx, a.mongoDB, a.hanaDB, shopReviewConfig)
+	})
+	if rc := a.reconcileConfig(); rc.Interval > 0 {
+		// in partitioned mode, every entity is reconciled by one replica
+		reconcileSchedulerConfig := a.schedulerConfig(config.PIPELINE_RECONCILE, metrics, assignment, nil, wd)
+		sv.Add("reconcile", func(ctx context.Context) error {
+			return schedulers.NewReconcileScheduler(ctx, a.mongoDB, a.hanaDB, reconcileSchedulerConfig, rc)
+		})
+	}
+	if elector != nil {
+		elector.Run(ctx, sv.Run)
+	} else {
+		sv.Run(ctx)
+	}
+	<-membershipDone
+	lg.Info("schedulers stopped")
+
+	// ctx is cancelled by now, so the shutdown gets a context of its own
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = server.Shutdown(shutdownCtx); err != nil {
+		lg.Error("error while stopping metrics server", zap.Error(err))
+	}
+	if adminServer != nil {
+		if err = adminServer.Shutdown(shutdownCtx); err != nil {
+			lg.Error("error while stopping admin server", zap.Error(err))
+		}
+	}
+	lg.Info("service stopped")
+	return nil
+}
@@ -0,0 +1,258 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-hana/internal/hana"
+	"go-hana/internal/mongodb"
+	"go-hana/internal/schedulers"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+const (
+	// maxBodySize bounds the body of a request
+	maxBodySize = 1 << 20
+)
+
+type Config struct {
+	// Token is the bearer token every request has to carry.
+	Token string
+	// Backfill is the scheduler configuration of the backfills started
+	// through the API.
+	Backfill schedulers.Config
+	// Leader only lets the leader run backfills, so their writes are fenced
+	// like the ones of the schedulers. Every replica runs them if it is nil.
+	Leader Leader
+}
+
+// Leader tells whether this replica holds the lease of the leader.
+type Leader interface {
+	// LeaderContext returns a context that carries the fencing token and is
+	// cancelled when the lease is lost. It reports false while this replica
+	// is a standby.
+	LeaderContext() (context.Context, bool)
+}
+
+// Server is the admin API, which lets on-call engineers control the
+// pipelines of this replica at runtime:
+//
+//	GET  /admin/entities                  lists the entities and their state
+//	POST /admin/entities/{name}/sync      starts the next pass right away
+//	POST /admin/entities/{name}/pause     pauses the pipeline
+//	POST /admin/entities/{name}/resume    resumes the pipeline
+//	POST /admin/entities/{name}/cancel    cancels the running pass
+//	POST /admin/entities/{name}/backfill  starts a backfill, see schedulers.Backfill
+type Server struct {
+	ctx      context.Context
+	cfg      Config
+	lg       *zap.Logger
+	mongoDB  *mongodb.DB
+	hanaDB   *hana.DB
+	controls schedulers.Controls
+}
+
+// New returns the admin API. Backfills started through it run until they
+// are done or ctx is cancelled.
+func New(ctx context.Context, lg *zap.Logger, mongoDB *mongodb.DB, hanaDB *hana.DB, controls schedulers.Controls,
+	cfg Config) *Server {
+	return &Server{
+		ctx:      ctx,
+		cfg:      cfg,
+		lg:       lg,
+		mongoDB:  mongoDB,
+		hanaDB:   hanaDB,
+		controls: controls,
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		s.lg.Warn("unauthorized admin request", zap.String("method", r.Method), zap.String("path", r.URL.Path),
+			zap.String("remote_addr", r.RemoteAddr))
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("invalid or missing bearer token"))
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "entities":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		writeJSON(w, http.StatusOK, s.controls.States())
+	case len(parts) == 3 && parts[0] == "entities":
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		s.act(w, r, parts[1], parts[2])
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown path %s", r.URL.Path))
+	}
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return s.cfg.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Token)) == 1
+}
+
+// act runs action on the pipeline of entity.
+func (s *Server) act(w http.ResponseWriter, r *http.Request, entity, action string) {
+	control, ok := s.controls[entity]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown entity %s", entity))
+		return
+	}
+
+	switch action {
+	case "sync":
+		control.Sync()
+	case "pause":
+		control.Pause()
+	case "resume":
+		control.Resume()
+	case "cancel":
+		if err := control.Cancel(); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+	case "backfill":
+		s.backfill(w, r, entity)
+		return
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown action %s", action))
+		return
+	}
+	s.lg.Info("admin action", zap.String("action", action), zap.String("entity", entity))
+	writeJSON(w, http.StatusOK, control.State())
+}
+
+// backfillRequest selects the documents of a backfill. The ids, bounds and
+// filter are extended JSON, so they match the _ids as they are typed in
+// MongoDB, e.g. integers and ObjectIds.
+type backfillRequest struct {
+	IDs    json.RawMessage `json:"ids"`
+	From   json.RawMessage `json:"from"`
+	To     json.RawMessage `json:"to"`
+	Filter json.RawMessage `json:"filter"`
+}
+
+// backfill parses the request into a backfill of entity.
+func (req backfillRequest) backfill(entity string) (schedulers.Backfill, error) {
+	b := schedulers.Backfill{Entity: entity}
+	if len(req.IDs) > 0 {
+		v, err := extJSONValue(req.IDs)
+		if err != nil {
+			return b, fmt.Errorf("invalid ids: %v", err)
+		}
+		list, ok := v.(primitive.A)
+		if !ok {
+			return b, fmt.Errorf("invalid ids: %s is not an array", req.IDs)
+		}
+		b.IDs = list
+	}
+	var err error
+	if len(req.From) > 0 {
+		if b.From, err = extJSONValue(req.From); err != nil {
+			return b, fmt.Errorf("invalid from: %v", err)
+		}
+	}
+	if len(req.To) > 0 {
+		if b.To, err = extJSONValue(req.To); err != nil {
+			return b, fmt.Errorf("invalid to: %v", err)
+		}
+	}
+	if len(req.Filter) > 0 {
+		var filter bson.M
+		if err = bson.UnmarshalExtJSON(req.Filter, false, &filter); err != nil {
+			return b, fmt.Errorf("invalid filter: %v", err)
+		}
+		b.Filter = filter
+	}
+	return b, b.Validate()
+}
+
+// extJSONValue parses a single value in extended JSON. A JSON null is no
+// value.
+func extJSONValue(raw json.RawMessage) (interface{}, error) {
+	var doc bson.M
+	if err := bson.UnmarshalExtJSON([]byte(`{"v": `+string(raw)+`}`), false, &doc); err != nil {
+		return nil, err
+	}
+	return doc["v"], nil
+}
+
+// backfill starts a backfill of entity in the background once it is known
+// to match documents. Its report is logged and recorded in ETL_RUNS once it
+// is done.
+func (s *Server) backfill(w http.ResponseWriter, r *http.Request, entity string) {
+	var req backfillRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %v", err))
+		return
+	}
+	b, err := req.backfill(entity)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := s.ctx
+	if s.cfg.Leader != nil {
+		var ok bool
+		if ctx, ok = s.cfg.Leader.LeaderContext(); !ok {
+			writeError(w, http.StatusConflict, errors.New("this replica is not the leader"))
+			return
+		}
+	}
+
+	// an _id of the wrong type matches nothing
+	matched, err := schedulers.CountBackfill(r.Context(), s.mongoDB, s.cfg.Backfill, b)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if matched == 0 {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Errorf("no %s match the backfill", entity))
+		return
+	}
+
+	go func() {
+		// the report is logged when the run is finished
+		if _, err := schedulers.RunBackfill(ctx, s.mongoDB, s.hanaDB, s.cfg.Backfill, b); err != nil {
+			s.lg.Error("error in backfill", zap.String("entity", entity), zap.Error(err))
+		}
+	}()
+	s.lg.Info("admin action", zap.String("action", "backfill"), zap.String("entity", entity),
+		zap.Int64("matched", matched))
+	writeJSON(w, http.StatusAccepted, backfillResponse{Entity: entity, Status: "started", Matched: matched})
+}
+
+// backfillResponse is the response to a backfill that was started.
+type backfillResponse struct {
+	Entity string `json:"entity"`
+	Status string `json:"status"`
+	// Matched is the number of documents selected when it was started.
+	Matched int64 `json:"matched"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	// the client went away if the response cannot be written
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,196 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"go-hana/internal/schedulers"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testToken = "secret"
+
+// standby is a replica that does not hold the lease.
+type standby struct{}
+
+func (standby) LeaderContext() (context.Context, bool) { return nil, false }
+
+func newTestServer(cfg Config) *Server {
+	cfg.Token = testToken
+	return New(context.Background(), zap.NewNop(), nil, nil, schedulers.NewControls(zap.NewNop()), cfg)
+}
+
+func serve(s *Server, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestAuthorization(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{name: "missing", token: "", want: http.StatusUnauthorized},
+		{name: "wrong", token: "guess", want: http.StatusUnauthorized},
+		{name: "valid", token: testToken, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(newTestServer(Config{}), http.MethodGet, "/admin/entities", tt.token, "")
+			if w.Code != tt.want {
+				t.Errorf("status code = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizationWithoutToken(t *testing.T) {
+	// an empty token must not let requests without one through
+	s := New(context.Background(), zap.NewNop(), nil, nil, schedulers.NewControls(zap.NewNop()), Config{})
+	if w := serve(s, http.MethodGet, "/admin/entities", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("status code = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   int
+	}{
+		{name: "list", method: http.MethodGet, path: "/admin/entities", want: http.StatusOK},
+		{name: "list with POST", method: http.MethodPost, path: "/admin/entities", want: http.StatusMethodNotAllowed},
+		{name: "pause", method: http.MethodPost, path: "/admin/entities/shops/pause", want: http.StatusOK},
+		{name: "resume", method: http.MethodPost, path: "/admin/entities/shops/resume", want: http.StatusOK},
+		{name: "sync", method: http.MethodPost, path: "/admin/entities/shops/sync", want: http.StatusOK},
+		{name: "action with GET", method: http.MethodGet, path: "/admin/entities/shops/pause", want: http.StatusMethodNotAllowed},
+		{name: "cancel without a pass", method: http.MethodPost, path: "/admin/entities/shops/cancel", want: http.StatusConflict},
+		{name: "unknown entity", method: http.MethodPost, path: "/admin/entities/users/pause", want: http.StatusNotFound},
+		{name: "unknown action", method: http.MethodPost, path: "/admin/entities/shops/restart", want: http.StatusNotFound},
+		{name: "unknown path", method: http.MethodGet, path: "/admin/runs", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(newTestServer(Config{}), tt.method, tt.path, testToken, "")
+			if w.Code != tt.want {
+				t.Errorf("status code = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	s := newTestServer(Config{})
+	var st schedulers.PipelineState
+	w := serve(s, http.MethodPost, "/admin/entities/shops/pause", testToken, "")
+	if err := json.NewDecoder(w.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if !st.Paused {
+		t.Error("pipeline is not paused after pause")
+	}
+
+	w = serve(s, http.MethodPost, "/admin/entities/shops/resume", testToken, "")
+	if err := json.NewDecoder(w.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Paused {
+		t.Error("pipeline is paused after resume")
+	}
+}
+
+func TestBackfillRequest(t *testing.T) {
+	oid, err := primitive.ObjectIDFromHex("5f1b0c3e9d1e8a2b3c4d5e6f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		body    string
+		want    schedulers.Backfill
+		wantErr bool
+	}{
+		{
+			name: "integer ids",
+			body: `{"ids": [1, 2]}`,
+			want: schedulers.Backfill{Entity: schedulers.SHOPS, IDs: []interface{}{int32(1), int32(2)}},
+		},
+		{
+			name: "object ids",
+			body: `{"ids": [{"$oid": "5f1b0c3e9d1e8a2b3c4d5e6f"}]}`,
+			want: schedulers.Backfill{Entity: schedulers.SHOPS, IDs: []interface{}{oid}},
+		},
+		{
+			name: "long range",
+			body: `{"from": {"$numberLong": "10"}, "to": {"$numberLong": "20"}}`,
+			want: schedulers.Backfill{Entity: schedulers.SHOPS, From: int64(10), To: int64(20)},
+		},
+		{
+			name: "open range",
+			body: `{"from": "a", "to": null}`,
+			want: schedulers.Backfill{Entity: schedulers.SHOPS, From: "a"},
+		},
+		{
+			name: "filter",
+			body: `{"filter": {"shopId": {"$oid": "5f1b0c3e9d1e8a2b3c4d5e6f"}}}`,
+			want: schedulers.Backfill{Entity: schedulers.SHOPS, Filter: map[string]interface{}{"shopId": oid}},
+		},
+		{name: "ids not an array", body: `{"ids": 1}`, wantErr: true},
+		{name: "invalid id", body: `{"ids": [{"$oid": "nope"}]}`, wantErr: true},
+		{name: "invalid filter", body: `{"filter": [1]}`, wantErr: true},
+		{name: "no selector", body: `{}`, wantErr: true},
+		{name: "two selectors", body: `{"ids": [1], "from": 1}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req backfillRequest
+			if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+				t.Fatal(err)
+			}
+			got, err := req.backfill(schedulers.SHOPS)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("backfill() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("backfill() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackfillRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		body string
+		want int
+	}{
+		{name: "invalid body", body: `{"ids": [1]`, want: http.StatusBadRequest},
+		{name: "unknown field type", body: `{"ids": [{"$oid": 1}]}`, want: http.StatusBadRequest},
+		{name: "no selector", body: `{}`, want: http.StatusBadRequest},
+		{name: "standby", cfg: Config{Leader: standby{}}, body: `{"ids": [1]}`, want: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(newTestServer(tt.cfg), http.MethodPost, "/admin/entities/shops/backfill", testToken, tt.body)
+			if w.Code != tt.want {
+				t.Errorf("status code = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package cluster
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go-hana/internal/mongodb"
+	"go.uber.org/zap"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	// Identity identifies this replica, e.g. the pod name.
+	Identity string
+	// HeartbeatInterval is how often the membership is renewed and the
+	// other members are looked up.
+	HeartbeatInterval time.Duration
+	// MemberTTL is how long a member stays registered without a heartbeat.
+	MemberTTL time.Duration
+	// VirtualNodes is the number of places every member takes on the ring.
+	VirtualNodes int
+}
+
+// Membership registers this replica in MongoDB and divides the work among
+// the live replicas with consistent hashing. The work is rebalanced whenever
+// a replica joins or leaves.
+type Membership struct {
+	cfg     Config
+	lg      *zap.Logger
+	mongoDB *mongodb.DB
+	size    prometheus.Gauge
+
+	mu      sync.RWMutex
+	members []string
+	ring    *ring
+	changed chan struct{}
+}
+
+func New(lg *zap.Logger, reg prometheus.Registerer, mongoDB *mongodb.DB, cfg Config) *Membership {
+	return &Membership{
+		cfg: cfg,
+		lg:  lg.With(zap.String("identity", cfg.Identity)),
+		size: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cluster_members",
+			Help: "The number of live replicas sharing the work",
+		}),
+		mongoDB: mongoDB,
+		ring:    newRing(nil, cfg.VirtualNodes),
+		changed: make(chan struct{}),
+	}
+}
+
+// Run keeps this replica registered until ctx is cancelled and unregisters
+// it afterwards, so its work moves to the others right away.
+func (m *Membership) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		m.refresh(ctx)
+
+		select {
+		case <-ctx.Done():
+			// ctx is cancelled already
+			rctx, cancel := context.WithTimeout(context.Background(), m.cfg.HeartbeatInterval)
+			defer cancel()
+			if err := m.mongoDB.RemoveMember(rctx, m.cfg.Identity); err != nil {
+				m.lg.Error("error while leaving the cluster", zap.Error(err))
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Membership) refresh(ctx context.Context) {
+	if err := m.mongoDB.Heartbeat(ctx, m.cfg.Identity, m.cfg.MemberTTL); err != nil {
+		m.lg.Error("error while sending heartbeat", zap.Error(err))
+		return
+	}
+	members, err := m.mongoDB.GetMembers(ctx)
+	if err != nil {
+		m.lg.Error("error while getting cluster members", zap.Error(err))
+		return
+	}
+	sort.Strings(members)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if strings.Join(members, ",") == strings.Join(m.members, ",") {
+		return
+	}
+	m.lg.Info("cluster members changed", zap.Strings("members", members))
+	m.size.Set(float64(len(members)))
+	m.members = members
+	m.ring = newRing(members, m.cfg.VirtualNodes)
+
+	// wake up everyone waiting for a rebalance
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// Owns reports whether key is assigned to this replica.
+func (m *Membership) Owns(key string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.ring.owner(key) == m.cfg.Identity
+}
+
+// Changed returns a channel that is closed when the members change.
+func (m *Membership) Changed() <-chan struct{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.changed
+}
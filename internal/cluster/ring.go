@@ -0,0 +1,57 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// ring is a consistent hash ring. Every member is placed on the ring several
+// times, so keys spread evenly and only the keys of a joining or leaving
+// member move to another one.
+type ring struct {
+	hashes  []uint32
+	members map[uint32]string
+}
+
+func newRing(members []string, virtualNodes int) *ring {
+	if virtualNodes < 1 {
+		virtualNodes = 1
+	}
+
+	r := &ring{members: make(map[uint32]string, len(members)*virtualNodes)}
+	for _, m := range members {
+		for i := 0; i < virtualNodes; i++ {
+			h := hash(m + "#" + strconv.Itoa(i))
+			r.hashes = append(r.hashes, h)
+			r.members[h] = m
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool {
+		return r.hashes[i] < r.hashes[j]
+	})
+	return r
+}
+
+// owner returns the member owning key, or "" if the ring is empty.
+func (r *ring) owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= h
+	})
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.members[r.hashes[i]]
+}
+
+// hash mixes all bits of s into the result. FNV spreads keys that differ only
+// in their last characters, like the virtual nodes of a member, unevenly.
+func hash(s string) uint32 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
@@ -0,0 +1,86 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRingOwner(t *testing.T) {
+	tests := []struct {
+		name         string
+		members      []string
+		virtualNodes int
+		want         []string
+	}{
+		{name: "empty", members: nil, virtualNodes: 10, want: []string{""}},
+		{name: "single member", members: []string{"a"}, virtualNodes: 10, want: []string{"a"}},
+		{name: "no virtual nodes", members: []string{"a"}, virtualNodes: 0, want: []string{"a"}},
+		{name: "several members", members: []string{"a", "b", "c"}, virtualNodes: 10, want: []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRing(tt.members, tt.virtualNodes)
+			for i := 0; i < 1000; i++ {
+				key := "products/" + strconv.Itoa(i)
+				owner := r.owner(key)
+				if !contains(tt.want, owner) {
+					t.Fatalf("owner(%q) = %q, want one of %q", key, owner, tt.want)
+				}
+				if again := r.owner(key); again != owner {
+					t.Fatalf("owner(%q) = %q, then %q", key, owner, again)
+				}
+			}
+		})
+	}
+}
+
+func TestRingMembersChange(t *testing.T) {
+	tests := []struct {
+		name   string
+		before []string
+		after  []string
+		// moved is the only member keys may move to or from
+		moved string
+	}{
+		{name: "member joins", before: []string{"a", "b"}, after: []string{"a", "b", "c"}, moved: "c"},
+		{name: "member leaves", before: []string{"a", "b", "c"}, after: []string{"a", "c"}, moved: "b"},
+		{name: "order does not matter", before: []string{"a", "b", "c"}, after: []string{"c", "a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, after := newRing(tt.before, 50), newRing(tt.after, 50)
+			for i := 0; i < 1000; i++ {
+				key := "offers/" + strconv.Itoa(i)
+				was, is := before.owner(key), after.owner(key)
+				if was != is && was != tt.moved && is != tt.moved {
+					t.Errorf("key %q moved from %q to %q", key, was, is)
+				}
+			}
+		})
+	}
+}
+
+func TestRingSpread(t *testing.T) {
+	members := []string{"a", "b", "c"}
+	r := newRing(members, 100)
+	counts := make(map[string]int)
+	const keys = 3000
+	for i := 0; i < keys; i++ {
+		counts[r.owner("shops/"+strconv.Itoa(i))]++
+	}
+	for _, m := range members {
+		// each member owns a third of the keys, give or take half of it
+		if counts[m] < keys/6 || counts[m] > keys/2 {
+			t.Errorf("member %q owns %d of %d keys", m, counts[m], keys)
+		}
+	}
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,412 @@
+package config
+
+import (
+	"fmt"
+	"go-hana/internal/schedulers"
+	"go-hana/internal/tracing"
+	"go.uber.org/zap/zapcore"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// the one-off jobs, which have pipeline settings of their own
+	PIPELINE_RECONCILE = "reconcile"
+	PIPELINE_BACKFILL  = "backfill"
+	PIPELINE_DLQ       = "dlq"
+	PIPELINE_DRYRUN    = "dryrun"
+)
+
+const (
+	// modes of running several replicas
+	CLUSTER_MODE_SINGLE      = "single"
+	CLUSTER_MODE_LEADER      = "leader"
+	CLUSTER_MODE_PARTITIONED = "partitioned"
+)
+
+// Config is the configuration of go-hana. It is read from a YAML file with
+// the same structure, the keys are the yaml tags.
+type Config struct {
+	Mongo     Mongo     `yaml:"mongo"`
+	Hana      Hana      `yaml:"hana"`
+	Log       Log       `yaml:"log"`
+	Tracing   Tracing   `yaml:"tracing"`
+	Metrics   Metrics   `yaml:"metrics"`
+	Admin     Admin     `yaml:"admin"`
+	Health    Health    `yaml:"health"`
+	Watchdog  Watchdog  `yaml:"watchdog"`
+	Cluster   Cluster   `yaml:"cluster"`
+	Restart   Restart   `yaml:"restart"`
+	Loading   Loading   `yaml:"loading"`
+	Pipelines Pipelines `yaml:"pipelines"`
+	Reconcile Reconcile `yaml:"reconcile"`
+}
+
+// Mongo is the connection to the source MongoDB.
+type Mongo struct {
+	URI string `yaml:"uri"`
+	// MaxPoolSize and MinPoolSize bound the connections to every server, the
+	// defaults of the driver apply if they are 0.
+	MaxPoolSize     int           `yaml:"maxPoolSize"`
+	MinPoolSize     int           `yaml:"minPoolSize"`
+	MaxConnIdleTime time.Duration `yaml:"maxConnIdleTime"`
+}
+
+// Hana is the connection to the target HANA database.
+type Hana struct {
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	// TLSServerName is the name the certificate of HANA is checked against,
+	// the host if it is empty.
+	TLSServerName string `yaml:"tlsServerName"`
+	// TLSRootCAFile is the CA certificate HANA is trusted by.
+	TLSRootCAFile string `yaml:"tlsRootCAFile"`
+	// MaxOpenConns caps the connections of the schedulers, 0 leaves them
+	// unbounded. Migrations hold a lock on one connection while they run on
+	// another, so it must not be 1.
+	MaxOpenConns    int           `yaml:"maxOpenConns"`
+	MaxIdleConns    int           `yaml:"maxIdleConns"`
+	ConnMaxLifetime time.Duration `yaml:"connMaxLifetime"`
+	ConnMaxIdleTime time.Duration `yaml:"connMaxIdleTime"`
+}
+
+// URI returns the DSN of the HANA connection.
+func (h Hana) URI() string {
+	serverName := h.TLSServerName
+	if serverName == "" {
+		serverName = h.Host
+	}
+	query := url.Values{}
+	query.Set("TLSServerName", serverName)
+	query.Set("TLSRootCAFile", h.TLSRootCAFile)
+	u := url.URL{
+		Scheme:   "hdb",
+		User:     url.UserPassword(h.User, h.Password),
+		Host:     h.Host + ":" + h.Port,
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
+
+type Log struct {
+	// Level is the minimum level of the logs, like info or debug.
+	Level string `yaml:"level"`
+	// Of the same message within a second, the first SamplingInitial are
+	// logged and every SamplingThereafter-th after that. Sampling is
+	// disabled if SamplingInitial is 0.
+	SamplingInitial    int `yaml:"samplingInitial"`
+	SamplingThereafter int `yaml:"samplingThereafter"`
+}
+
+type Tracing struct {
+	// Exporter is one of the tracing.EXPORTER_* constants.
+	Exporter    string  `yaml:"exporter"`
+	Endpoint    string  `yaml:"endpoint"`
+	Insecure    bool    `yaml:"insecure"`
+	SampleRatio float64 `yaml:"sampleRatio"`
+	ServiceName string  `yaml:"serviceName"`
+}
+
+// Metrics is the listener of the metrics and the probes.
+type Metrics struct {
+	Addr string `yaml:"addr"`
+}
+
+// Admin is the admin API, which is disabled without a token.
+type Admin struct {
+	Token string `yaml:"token"`
+	// Addr is the listener of the admin API. It is served by the metrics
+	// listener if it is empty.
+	Addr string `yaml:"addr"`
+}
+
+type Health struct {
+	Timeout   time.Duration `yaml:"timeout"`
+	Staleness time.Duration `yaml:"staleness"`
+}
+
+type Watchdog struct {
+	Interval         time.Duration `yaml:"interval"`
+	Timeout          time.Duration `yaml:"timeout"`
+	FailureThreshold int           `yaml:"failureThreshold"`
+}
+
+type Cluster struct {
+	// Mode is one of the CLUSTER_MODE_* constants.
+	Mode string `yaml:"mode"`
+	// Identity names this replica, the host name if it is not set.
+	Identity string `yaml:"identity"`
+	// partitioned mode
+	HeartbeatInterval time.Duration `yaml:"heartbeatInterval"`
+	MemberTTL         time.Duration `yaml:"memberTTL"`
+	VirtualNodes      int           `yaml:"virtualNodes"`
+	// leader mode
+	LeaseDuration time.Duration `yaml:"leaseDuration"`
+	RenewInterval time.Duration `yaml:"renewInterval"`
+}
+
+// Restart is the restart policy of failed pipelines.
+type Restart struct {
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+	Jitter         float64       `yaml:"jitter"`
+	MaxRestarts    int           `yaml:"maxRestarts"`
+	Window         time.Duration `yaml:"window"`
+}
+
+// Loading holds the settings shared by all pipelines.
+type Loading struct {
+	PageSize    int           `yaml:"pageSize"`
+	GracePeriod time.Duration `yaml:"gracePeriod"`
+	Retry       Retry         `yaml:"retry"`
+	Timeouts    Timeouts      `yaml:"timeouts"`
+}
+
+type Retry struct {
+	Attempts   int           `yaml:"attempts"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+}
+
+type Timeouts struct {
+	Read       time.Duration `yaml:"read"`
+	Write      time.Duration `yaml:"write"`
+	Checkpoint time.Duration `yaml:"checkpoint"`
+}
+
+// Pipelines are the settings of every entity and one-off job.
+type Pipelines struct {
+	Offers      Pipeline `yaml:"offers"`
+	Products    Pipeline `yaml:"products"`
+	Shops       Pipeline `yaml:"shops"`
+	ShopReviews Pipeline `yaml:"shop_reviews"`
+	Reconcile   Pipeline `yaml:"reconcile"`
+	Backfill    Pipeline `yaml:"backfill"`
+	DLQ         Pipeline `yaml:"dlq"`
+	DryRun      Pipeline `yaml:"dryrun"`
+}
+
+// Pipeline is the concurrency and the schedule of a pipeline.
+type Pipeline struct {
+	Workers    int `yaml:"workers"`
+	Partitions int `yaml:"partitions"`
+	// PassInterval is the wait between two passes over the entity.
+	PassInterval time.Duration `yaml:"passInterval"`
+}
+
+type Reconcile struct {
+	// Interval is the schedule of the reconciliation, which is disabled if
+	// it is 0.
+	Interval time.Duration `yaml:"interval"`
+	Buckets  int           `yaml:"buckets"`
+	Enqueue  bool          `yaml:"enqueue"`
+}
+
+// pipelines lists the pipelines with the prefix of their environment
+// variables.
+var pipelines = []struct {
+	name   string
+	prefix string
+	get    func(p *Pipelines) *Pipeline
+}{
+	{schedulers.OFFERS, "OFFER", func(p *Pipelines) *Pipeline { return &p.Offers }},
+	{schedulers.PRODUCTS, "PRODUCT", func(p *Pipelines) *Pipeline { return &p.Products }},
+	{schedulers.SHOPS, "SHOP", func(p *Pipelines) *Pipeline { return &p.Shops }},
+	{schedulers.SHOP_REVIEWS, "SHOP_REVIEW", func(p *Pipelines) *Pipeline { return &p.ShopReviews }},
+	{PIPELINE_RECONCILE, "RECONCILE", func(p *Pipelines) *Pipeline { return &p.Reconcile }},
+	{PIPELINE_BACKFILL, "BACKFILL", func(p *Pipelines) *Pipeline { return &p.Backfill }},
+	{PIPELINE_DLQ, "DLQ", func(p *Pipelines) *Pipeline { return &p.DLQ }},
+	{PIPELINE_DRYRUN, "DRYRUN", func(p *Pipelines) *Pipeline { return &p.DryRun }},
+}
+
+// Pipeline returns the settings of the pipeline name, which is an entity or
+// one of the PIPELINE_* constants.
+func (c *Config) Pipeline(name string) Pipeline {
+	for _, p := range pipelines {
+		if p.name == name {
+			return *p.get(&c.Pipelines)
+		}
+	}
+	return Pipeline{}
+}
+
+// Default returns the configuration used for everything that is not set.
+func Default() *Config {
+	identity, _ := os.Hostname()
+	cfg := &Config{
+		Hana: Hana{
+			TLSRootCAFile:   "DigiCertGlobalRootCA.crt.pem",
+			MaxOpenConns:    16,
+			MaxIdleConns:    16,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+		},
+		Log: Log{
+			Level:              "info",
+			SamplingInitial:    100,
+			SamplingThereafter: 100,
+		},
+		Tracing: Tracing{
+			Exporter:    tracing.EXPORTER_NONE,
+			Endpoint:    "localhost:4317",
+			Insecure:    true,
+			SampleRatio: 1,
+			ServiceName: "go-hana",
+		},
+		Metrics: Metrics{Addr: ":9090"},
+		Health: Health{
+			Timeout:   5 * time.Second,
+			Staleness: 10 * time.Minute,
+		},
+		Watchdog: Watchdog{
+			Interval:         10 * time.Second,
+			Timeout:          5 * time.Second,
+			FailureThreshold: 3,
+		},
+		Cluster: Cluster{
+			Mode:              CLUSTER_MODE_SINGLE,
+			Identity:          identity,
+			HeartbeatInterval: 5 * time.Second,
+			MemberTTL:         20 * time.Second,
+			VirtualNodes:      64,
+			LeaseDuration:     15 * time.Second,
+			RenewInterval:     2 * time.Second,
+		},
+		Restart: Restart{
+			InitialBackoff: time.Second,
+			MaxBackoff:     5 * time.Minute,
+			Jitter:         0.2,
+			MaxRestarts:    5,
+			Window:         30 * time.Minute,
+		},
+		Loading: Loading{
+			PageSize:    1000,
+			GracePeriod: 30 * time.Second,
+			Retry: Retry{
+				Attempts:   3,
+				Backoff:    100 * time.Millisecond,
+				MaxBackoff: 2 * time.Second,
+			},
+			Timeouts: Timeouts{
+				Read:       30 * time.Second,
+				Write:      30 * time.Second,
+				Checkpoint: 10 * time.Second,
+			},
+		},
+		Reconcile: Reconcile{Buckets: 64},
+	}
+	for _, p := range pipelines {
+		*p.get(&cfg.Pipelines) = Pipeline{Workers: 4, Partitions: 4}
+	}
+	return cfg
+}
+
+// Validate checks the configuration and lists all of its problems.
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	nonNegative := func(name string, d time.Duration) {
+		check(d >= 0, "%s must not be negative", name)
+	}
+
+	check(c.Mongo.URI != "", "mongo.uri is required")
+	check(c.Mongo.MaxPoolSize >= 0, "mongo.maxPoolSize must not be negative")
+	check(c.Mongo.MinPoolSize >= 0, "mongo.minPoolSize must not be negative")
+	check(c.Mongo.MaxPoolSize == 0 || c.Mongo.MinPoolSize <= c.Mongo.MaxPoolSize,
+		"mongo.minPoolSize must not exceed mongo.maxPoolSize")
+	nonNegative("mongo.maxConnIdleTime", c.Mongo.MaxConnIdleTime)
+
+	check(c.Hana.Host != "", "hana.host is required")
+	check(c.Hana.Port != "", "hana.port is required")
+	check(c.Hana.User != "", "hana.user is required")
+	check(c.Hana.MaxOpenConns >= 0, "hana.maxOpenConns must not be negative")
+	check(c.Hana.MaxOpenConns != 1, "hana.maxOpenConns must be 0 or at least 2, migrations need two connections")
+	check(c.Hana.MaxIdleConns >= 0, "hana.maxIdleConns must not be negative")
+	nonNegative("hana.connMaxLifetime", c.Hana.ConnMaxLifetime)
+	nonNegative("hana.connMaxIdleTime", c.Hana.ConnMaxIdleTime)
+	if c.Hana.TLSRootCAFile != "" {
+		_, err := os.Stat(c.Hana.TLSRootCAFile)
+		check(err == nil, "hana.tlsRootCAFile: %v", err)
+	}
+
+	var level zapcore.Level
+	err := level.UnmarshalText([]byte(c.Log.Level))
+	check(err == nil, "log.level: %v", err)
+	check(c.Log.SamplingInitial >= 0, "log.samplingInitial must not be negative")
+	check(c.Log.SamplingInitial == 0 || c.Log.SamplingThereafter > 0,
+		"log.samplingThereafter must be positive while sampling is enabled")
+
+	switch c.Tracing.Exporter {
+	case tracing.EXPORTER_NONE, tracing.EXPORTER_STDOUT:
+	case tracing.EXPORTER_OTLP:
+		check(c.Tracing.Endpoint != "", "tracing.endpoint is required by the otlp exporter")
+	default:
+		problems = append(problems, fmt.Sprintf("tracing.exporter must be one of %s, %s and %s, not %q",
+			tracing.EXPORTER_NONE, tracing.EXPORTER_STDOUT, tracing.EXPORTER_OTLP, c.Tracing.Exporter))
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sampleRatio must be between 0 and 1")
+
+	check(c.Metrics.Addr != "", "metrics.addr is required")
+	check(c.Admin.Addr == "" || c.Admin.Addr != c.Metrics.Addr,
+		"admin.addr must differ from metrics.addr, leave it empty to share the listener")
+
+	check(c.Health.Timeout > 0, "health.timeout must be positive")
+	check(c.Health.Staleness > 0, "health.staleness must be positive")
+	check(c.Watchdog.Interval > 0, "watchdog.interval must be positive")
+	check(c.Watchdog.Timeout > 0, "watchdog.timeout must be positive")
+	check(c.Watchdog.FailureThreshold >= 1, "watchdog.failureThreshold must be at least 1")
+
+	switch c.Cluster.Mode {
+	case CLUSTER_MODE_SINGLE:
+	case CLUSTER_MODE_LEADER:
+		check(c.Cluster.Identity != "", "cluster.identity is required in leader mode")
+		check(c.Cluster.RenewInterval > 0 && c.Cluster.RenewInterval < c.Cluster.LeaseDuration,
+			"cluster.renewInterval must be positive and shorter than cluster.leaseDuration")
+	case CLUSTER_MODE_PARTITIONED:
+		check(c.Cluster.Identity != "", "cluster.identity is required in partitioned mode")
+		check(c.Cluster.HeartbeatInterval > 0 && c.Cluster.HeartbeatInterval < c.Cluster.MemberTTL,
+			"cluster.heartbeatInterval must be positive and shorter than cluster.memberTTL")
+		check(c.Cluster.VirtualNodes >= 1, "cluster.virtualNodes must be at least 1")
+	default:
+		problems = append(problems, fmt.Sprintf("cluster.mode must be one of %s, %s and %s, not %q",
+			CLUSTER_MODE_SINGLE, CLUSTER_MODE_LEADER, CLUSTER_MODE_PARTITIONED, c.Cluster.Mode))
+	}
+
+	check(c.Restart.InitialBackoff > 0, "restart.initialBackoff must be positive")
+	check(c.Restart.MaxBackoff >= c.Restart.InitialBackoff, "restart.maxBackoff must not be shorter than restart.initialBackoff")
+	check(c.Restart.Jitter >= 0, "restart.jitter must not be negative")
+	check(c.Restart.MaxRestarts >= 0, "restart.maxRestarts must not be negative")
+	nonNegative("restart.window", c.Restart.Window)
+
+	check(c.Loading.PageSize >= 1, "loading.pageSize must be at least 1")
+	nonNegative("loading.gracePeriod", c.Loading.GracePeriod)
+	check(c.Loading.Retry.Attempts >= 1, "loading.retry.attempts must be at least 1")
+	nonNegative("loading.retry.backoff", c.Loading.Retry.Backoff)
+	check(c.Loading.Retry.MaxBackoff >= c.Loading.Retry.Backoff, "loading.retry.maxBackoff must not be shorter than loading.retry.backoff")
+	nonNegative("loading.timeouts.read", c.Loading.Timeouts.Read)
+	nonNegative("loading.timeouts.write", c.Loading.Timeouts.Write)
+	nonNegative("loading.timeouts.checkpoint", c.Loading.Timeouts.Checkpoint)
+
+	for _, p := range pipelines {
+		pc := p.get(&c.Pipelines)
+		check(pc.Workers >= 1, "pipelines.%s.workers must be at least 1", p.name)
+		check(pc.Partitions >= 1, "pipelines.%s.partitions must be at least 1", p.name)
+		nonNegative("pipelines."+p.name+".passInterval", pc.PassInterval)
+	}
+
+	nonNegative("reconcile.interval", c.Reconcile.Interval)
+	check(c.Reconcile.Buckets >= 1, "reconcile.buckets must be at least 1")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
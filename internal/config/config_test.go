@@ -0,0 +1,143 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// valid returns a configuration that passes Validate.
+func valid() *Config {
+	cfg := Default()
+	cfg.Mongo.URI = "mongodb://localhost:27017"
+	cfg.Hana.Host = "hana.local"
+	cfg.Hana.Port = "443"
+	cfg.Hana.User = "ETL"
+	cfg.Hana.TLSRootCAFile = ""
+	return cfg
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		// want are parts of the expected problems, none if it is empty
+		want []string
+	}{
+		{name: "valid", modify: func(c *Config) {}},
+		{
+			name:   "required connections",
+			modify: func(c *Config) { c.Mongo.URI, c.Hana.Host, c.Hana.Port, c.Hana.User = "", "", "", "" },
+			want:   []string{"mongo.uri is required", "hana.host is required", "hana.port is required", "hana.user is required"},
+		},
+		{
+			name:   "pool sizes",
+			modify: func(c *Config) { c.Mongo.MaxPoolSize, c.Mongo.MinPoolSize = 5, 10 },
+			want:   []string{"mongo.minPoolSize must not exceed mongo.maxPoolSize"},
+		},
+		{
+			name:   "single HANA connection",
+			modify: func(c *Config) { c.Hana.MaxOpenConns = 1 },
+			want:   []string{"hana.maxOpenConns must be 0 or at least 2"},
+		},
+		{
+			name:   "missing CA file",
+			modify: func(c *Config) { c.Hana.TLSRootCAFile = "missing.pem" },
+			want:   []string{"hana.tlsRootCAFile"},
+		},
+		{
+			name:   "log level",
+			modify: func(c *Config) { c.Log.Level = "loud" },
+			want:   []string{"log.level"},
+		},
+		{
+			name:   "tracing exporter",
+			modify: func(c *Config) { c.Tracing.Exporter = "jaeger" },
+			want:   []string{`tracing.exporter must be one of none, stdout and otlp, not "jaeger"`},
+		},
+		{
+			name:   "otlp endpoint",
+			modify: func(c *Config) { c.Tracing.Exporter, c.Tracing.Endpoint = "otlp", "" },
+			want:   []string{"tracing.endpoint is required by the otlp exporter"},
+		},
+		{
+			name:   "shared admin listener",
+			modify: func(c *Config) { c.Admin.Addr = c.Metrics.Addr },
+			want:   []string{"admin.addr must differ from metrics.addr"},
+		},
+		{
+			name:   "cluster mode",
+			modify: func(c *Config) { c.Cluster.Mode = "active" },
+			want:   []string{"cluster.mode must be one of"},
+		},
+		{
+			name: "lease renewal",
+			modify: func(c *Config) {
+				c.Cluster.Mode = CLUSTER_MODE_LEADER
+				c.Cluster.RenewInterval = c.Cluster.LeaseDuration
+			},
+			want: []string{"cluster.renewInterval must be positive and shorter than cluster.leaseDuration"},
+		},
+		{
+			name: "partitioned mode",
+			modify: func(c *Config) {
+				c.Cluster.Mode = CLUSTER_MODE_PARTITIONED
+				c.Cluster.Identity = ""
+				c.Cluster.VirtualNodes = 0
+			},
+			want: []string{"cluster.identity is required in partitioned mode", "cluster.virtualNodes must be at least 1"},
+		},
+		{
+			name:   "pipeline workers",
+			modify: func(c *Config) { c.Pipelines.Offers.Workers = 0 },
+			want:   []string{"pipelines.offers.workers must be at least 1"},
+		},
+		{
+			name:   "negative durations",
+			modify: func(c *Config) { c.Loading.Timeouts.Read, c.Reconcile.Interval = -time.Second, -time.Second },
+			want:   []string{"loading.timeouts.read must not be negative", "reconcile.interval must not be negative"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.modify(cfg)
+			err := cfg.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate() = nil, want %q", tt.want)
+			}
+			// every problem is reported at once
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate() = %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	cfg := valid()
+	cfg.Pipelines.Offers = Pipeline{Workers: 8, Partitions: 2}
+	tests := []struct {
+		name string
+		want Pipeline
+	}{
+		{name: "offers", want: Pipeline{Workers: 8, Partitions: 2}},
+		{name: PIPELINE_BACKFILL, want: Pipeline{Workers: 4, Partitions: 4}},
+		{name: "unknown", want: Pipeline{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cfg.Pipeline(tt.name); got != tt.want {
+				t.Errorf("Pipeline(%q) = %+v, want %+v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// CONFIG_FILE_ENV names the configuration file unless the -config flag
+	// is given
+	CONFIG_FILE_ENV = "CONFIG_FILE"
+)
+
+// setting is a single value of the configuration, which can be set by an
+// environment variable and by a flag named like its path in the YAML file.
+type setting struct {
+	path string
+	env  string
+	// value returns the pointer to the value in cfg
+	value func(cfg *Config) interface{}
+}
+
+// settings lists every value of the configuration. The environment
+// variables are the ones go-hana has always been configured with.
+func settings() []setting {
+	s := []setting{
+		{"mongo.uri", "MONGO_URI", func(c *Config) interface{} { return &c.Mongo.URI }},
+		{"mongo.maxPoolSize", "MONGO_MAX_POOL_SIZE", func(c *Config) interface{} { return &c.Mongo.MaxPoolSize }},
+		{"mongo.minPoolSize", "MONGO_MIN_POOL_SIZE", func(c *Config) interface{} { return &c.Mongo.MinPoolSize }},
+		{"mongo.maxConnIdleTime", "MONGO_MAX_CONN_IDLE_TIME", func(c *Config) interface{} { return &c.Mongo.MaxConnIdleTime }},
+
+		{"hana.host", "HANA_HOST", func(c *Config) interface{} { return &c.Hana.Host }},
+		{"hana.port", "HANA_PORT", func(c *Config) interface{} { return &c.Hana.Port }},
+		{"hana.user", "HANA_USER", func(c *Config) interface{} { return &c.Hana.User }},
+		{"hana.password", "HANA_PASSWORD", func(c *Config) interface{} { return &c.Hana.Password }},
+		{"hana.tlsServerName", "HANA_TLS_SERVER_NAME", func(c *Config) interface{} { return &c.Hana.TLSServerName }},
+		{"hana.tlsRootCAFile", "HANA_TLS_ROOT_CA_FILE", func(c *Config) interface{} { return &c.Hana.TLSRootCAFile }},
+		{"hana.maxOpenConns", "HANA_MAX_OPEN_CONNS", func(c *Config) interface{} { return &c.Hana.MaxOpenConns }},
+		{"hana.maxIdleConns", "HANA_MAX_IDLE_CONNS", func(c *Config) interface{} { return &c.Hana.MaxIdleConns }},
+		{"hana.connMaxLifetime", "HANA_CONN_MAX_LIFETIME", func(c *Config) interface{} { return &c.Hana.ConnMaxLifetime }},
+		{"hana.connMaxIdleTime", "HANA_CONN_MAX_IDLE_TIME", func(c *Config) interface{} { return &c.Hana.ConnMaxIdleTime }},
+
+		{"log.level", "LOG_LEVEL", func(c *Config) interface{} { return &c.Log.Level }},
+		{"log.samplingInitial", "LOG_SAMPLING_INITIAL", func(c *Config) interface{} { return &c.Log.SamplingInitial }},
+		{"log.samplingThereafter", "LOG_SAMPLING_THEREAFTER", func(c *Config) interface{} { return &c.Log.SamplingThereafter }},
+
+		{"tracing.exporter", "OTEL_EXPORTER", func(c *Config) interface{} { return &c.Tracing.Exporter }},
+		{"tracing.endpoint", "OTEL_EXPORTER_OTLP_ENDPOINT", func(c *Config) interface{} { return &c.Tracing.Endpoint }},
+		{"tracing.insecure", "OTEL_EXPORTER_OTLP_INSECURE", func(c *Config) interface{} { return &c.Tracing.Insecure }},
+		{"tracing.sampleRatio", "OTEL_SAMPLE_RATIO", func(c *Config) interface{} { return &c.Tracing.SampleRatio }},
+		{"tracing.serviceName", "OTEL_SERVICE_NAME", func(c *Config) interface{} { return &c.Tracing.ServiceName }},
+
+		{"metrics.addr", "METRICS_ADDR", func(c *Config) interface{} { return &c.Metrics.Addr }},
+		{"admin.token", "ADMIN_TOKEN", func(c *Config) interface{} { return &c.Admin.Token }},
+		{"admin.addr", "ADMIN_ADDR", func(c *Config) interface{} { return &c.Admin.Addr }},
+
+		{"health.timeout", "HEALTH_TIMEOUT", func(c *Config) interface{} { return &c.Health.Timeout }},
+		{"health.staleness", "HEALTH_STALENESS", func(c *Config) interface{} { return &c.Health.Staleness }},
+
+		{"watchdog.interval", "WATCHDOG_INTERVAL", func(c *Config) interface{} { return &c.Watchdog.Interval }},
+		{"watchdog.timeout", "WATCHDOG_TIMEOUT", func(c *Config) interface{} { return &c.Watchdog.Timeout }},
+		{"watchdog.failureThreshold", "WATCHDOG_FAILURE_THRESHOLD", func(c *Config) interface{} { return &c.Watchdog.FailureThreshold }},
+
+		{"cluster.mode", "CLUSTER_MODE", func(c *Config) interface{} { return &c.Cluster.Mode }},
+		{"cluster.identity", "CLUSTER_IDENTITY", func(c *Config) interface{} { return &c.Cluster.Identity }},
+		{"cluster.heartbeatInterval", "CLUSTER_HEARTBEAT_INTERVAL", func(c *Config) interface{} { return &c.Cluster.HeartbeatInterval }},
+		{"cluster.memberTTL", "CLUSTER_MEMBER_TTL", func(c *Config) interface{} { return &c.Cluster.MemberTTL }},
+		{"cluster.virtualNodes", "CLUSTER_VIRTUAL_NODES", func(c *Config) interface{} { return &c.Cluster.VirtualNodes }},
+		{"cluster.leaseDuration", "LEADER_LEASE_DURATION", func(c *Config) interface{} { return &c.Cluster.LeaseDuration }},
+		{"cluster.renewInterval", "LEADER_RENEW_INTERVAL", func(c *Config) interface{} { return &c.Cluster.RenewInterval }},
+
+		{"restart.initialBackoff", "RESTART_INITIAL_BACKOFF", func(c *Config) interface{} { return &c.Restart.InitialBackoff }},
+		{"restart.maxBackoff", "RESTART_MAX_BACKOFF", func(c *Config) interface{} { return &c.Restart.MaxBackoff }},
+		{"restart.jitter", "RESTART_JITTER", func(c *Config) interface{} { return &c.Restart.Jitter }},
+		{"restart.maxRestarts", "RESTART_MAX_RESTARTS", func(c *Config) interface{} { return &c.Restart.MaxRestarts }},
+		{"restart.window", "RESTART_WINDOW", func(c *Config) interface{} { return &c.Restart.Window }},
+
+		{"loading.pageSize", "PAGE_SIZE", func(c *Config) interface{} { return &c.Loading.PageSize }},
+		{"loading.gracePeriod", "SHUTDOWN_GRACE_PERIOD", func(c *Config) interface{} { return &c.Loading.GracePeriod }},
+		{"loading.retry.attempts", "RETRY_ATTEMPTS", func(c *Config) interface{} { return &c.Loading.Retry.Attempts }},
+		{"loading.retry.backoff", "RETRY_BACKOFF", func(c *Config) interface{} { return &c.Loading.Retry.Backoff }},
+		{"loading.retry.maxBackoff", "RETRY_MAX_BACKOFF", func(c *Config) interface{} { return &c.Loading.Retry.MaxBackoff }},
+		{"loading.timeouts.read", "READ_TIMEOUT", func(c *Config) interface{} { return &c.Loading.Timeouts.Read }},
+		{"loading.timeouts.write", "WRITE_TIMEOUT", func(c *Config) interface{} { return &c.Loading.Timeouts.Write }},
+		{"loading.timeouts.checkpoint", "CHECKPOINT_TIMEOUT", func(c *Config) interface{} { return &c.Loading.Timeouts.Checkpoint }},
+
+		{"reconcile.interval", "RECONCILE_INTERVAL", func(c *Config) interface{} { return &c.Reconcile.Interval }},
+		{"reconcile.buckets", "RECONCILE_BUCKETS", func(c *Config) interface{} { return &c.Reconcile.Buckets }},
+		{"reconcile.enqueue", "RECONCILE_ENQUEUE", func(c *Config) interface{} { return &c.Reconcile.Enqueue }},
+	}
+	for _, p := range pipelines {
+		get := p.get
+		path := "pipelines." + p.name
+		s = append(s,
+			setting{path + ".workers", p.prefix + "_WORKERS",
+				func(c *Config) interface{} { return &get(&c.Pipelines).Workers }},
+			setting{path + ".partitions", p.prefix + "_PARTITIONS",
+				func(c *Config) interface{} { return &get(&c.Pipelines).Partitions }},
+			setting{path + ".passInterval", p.prefix + "_PASS_INTERVAL",
+				func(c *Config) interface{} { return &get(&c.Pipelines).PassInterval }},
+		)
+	}
+	return s
+}
+
+// Load builds the configuration in layers, each overriding the one before:
+//
+//  1. the defaults
+//  2. the YAML file named by the -config flag or CONFIG_FILE
+//  3. the environment variables that are set and not empty
+//  4. the flags of args, like -hana.host or -pipelines.offers.workers
+//
+// The flags are added to fs, which may define flags of its own, and args are
+// parsed by it. The result is validated. The error is flag.ErrHelp if the
+// usage was requested.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	file := fs.String("config", os.Getenv(CONFIG_FILE_ENV), "the YAML configuration file")
+
+	cfg := Default()
+	all := settings()
+	flags := make(map[string]*flagValue, len(all))
+	for _, s := range all {
+		_, isBool := s.value(cfg).(*bool)
+		fv := &flagValue{isBool: isBool}
+		flags[s.path] = fv
+		fs.Var(fv, s.path, "overrides "+s.env)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *file != "" {
+		if err := readFile(cfg, *file); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range all {
+		if value, ok := os.LookupEnv(s.env); ok && value != "" {
+			if err := parse(s.value(cfg), value); err != nil {
+				return nil, fmt.Errorf("invalid value of %s: %v", s.env, err)
+			}
+		}
+	}
+	for _, s := range all {
+		if fv := flags[s.path]; fv.set {
+			if err := parse(s.value(cfg), fv.value); err != nil {
+				return nil, fmt.Errorf("invalid value of -%s: %v", s.path, err)
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readFile overlays cfg with the YAML file. Unknown keys are errors, so
+// typos do not go unnoticed.
+func readFile(cfg *Config, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err = dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %v", file, err)
+	}
+	return nil
+}
+
+// parse sets the value at ptr from s.
+func parse(ptr interface{}, s string) error {
+	switch v := ptr.(type) {
+	case *string:
+		*v = s
+	case *int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		*v = i
+	case *bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		*v = b
+	case *float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		*v = f
+	case *time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*v = d
+	default:
+		return fmt.Errorf("unsupported type %T", ptr)
+	}
+	return nil
+}
+
+// flagValue keeps the value of a flag until the layers below it are loaded.
+type flagValue struct {
+	value  string
+	set    bool
+	isBool bool
+}
+
+func (f *flagValue) String() string { return f.value }
+
+func (f *flagValue) Set(s string) error {
+	f.value = s
+	f.set = true
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool { return f.isBool }
@@ -0,0 +1,168 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// required are the settings without a default, given as flags unless a test
+// sets them otherwise.
+var required = []string{
+	"-mongo.uri=mongodb://localhost:27017",
+	"-hana.host=hana.local",
+	"-hana.port=443",
+	"-hana.user=ETL",
+	"-hana.tlsRootCAFile=",
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		// check is called with the loaded configuration
+		check   func(t *testing.T, cfg *Config)
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Pipelines.Offers.Workers != 4 || cfg.Loading.PageSize != 1000 {
+					t.Errorf("workers = %d, page size = %d, want the defaults", cfg.Pipelines.Offers.Workers, cfg.Loading.PageSize)
+				}
+			},
+		},
+		{
+			name: "file overrides defaults",
+			file: "loading:\n  pageSize: 500\npipelines:\n  offers:\n    workers: 6\n",
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Pipelines.Offers.Workers != 6 || cfg.Loading.PageSize != 500 {
+					t.Errorf("workers = %d, page size = %d, want the file", cfg.Pipelines.Offers.Workers, cfg.Loading.PageSize)
+				}
+				// the values the file leaves out keep their defaults
+				if cfg.Pipelines.Products.Workers != 4 {
+					t.Errorf("products workers = %d, want 4", cfg.Pipelines.Products.Workers)
+				}
+			},
+		},
+		{
+			name: "environment overrides file",
+			file: "pipelines:\n  offers:\n    workers: 6\n",
+			env:  map[string]string{"OFFER_WORKERS": "8", "SHUTDOWN_GRACE_PERIOD": "45s", "RECONCILE_ENQUEUE": "true"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Pipelines.Offers.Workers != 8 {
+					t.Errorf("workers = %d, want 8", cfg.Pipelines.Offers.Workers)
+				}
+				if cfg.Loading.GracePeriod != 45*time.Second || !cfg.Reconcile.Enqueue {
+					t.Errorf("grace period = %v, enqueue = %v, want the environment", cfg.Loading.GracePeriod, cfg.Reconcile.Enqueue)
+				}
+			},
+		},
+		{
+			name: "empty environment is ignored",
+			file: "pipelines:\n  offers:\n    workers: 6\n",
+			env:  map[string]string{"OFFER_WORKERS": ""},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Pipelines.Offers.Workers != 6 {
+					t.Errorf("workers = %d, want 6", cfg.Pipelines.Offers.Workers)
+				}
+			},
+		},
+		{
+			name: "flags override environment",
+			env:  map[string]string{"OFFER_WORKERS": "8", "CLUSTER_MODE": "leader"},
+			args: []string{"-pipelines.offers.workers=2", "-cluster.mode", "partitioned", "-reconcile.enqueue"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Pipelines.Offers.Workers != 2 || cfg.Cluster.Mode != CLUSTER_MODE_PARTITIONED {
+					t.Errorf("workers = %d, mode = %s, want the flags", cfg.Pipelines.Offers.Workers, cfg.Cluster.Mode)
+				}
+				if !cfg.Reconcile.Enqueue {
+					t.Error("enqueue = false, want the boolean flag")
+				}
+			},
+		},
+		{
+			name:    "invalid environment",
+			env:     map[string]string{"PAGE_SIZE": "many"},
+			wantErr: "invalid value of PAGE_SIZE",
+		},
+		{
+			name:    "invalid flag",
+			args:    []string{"-loading.gracePeriod=soon"},
+			wantErr: "invalid value of -loading.gracePeriod",
+		},
+		{
+			name:    "unknown key in file",
+			file:    "loading:\n  pagesize: 500\n",
+			wantErr: "field pagesize not found",
+		},
+		{
+			name:    "invalid result",
+			args:    []string{"-pipelines.offers.workers=0"},
+			wantErr: "pipelines.offers.workers must be at least 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(CONFIG_FILE_ENV, "")
+			for _, s := range settings() {
+				if _, ok := os.LookupEnv(s.env); ok {
+					t.Setenv(s.env, "")
+				}
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			args := append([]string{}, required...)
+			if tt.file != "" {
+				file := filepath.Join(t.TempDir(), "go-hana.yml")
+				if err := os.WriteFile(file, []byte(tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				args = append(args, "-config", file)
+			}
+			args = append(args, tt.args...)
+
+			fs := flag.NewFlagSet("go-hana", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			cfg, err := Load(fs, args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
+
+func TestLoadHelp(t *testing.T) {
+	fs := flag.NewFlagSet("go-hana", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if _, err := Load(fs, []string{"-help"}); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("Load() error = %v, want flag.ErrHelp", err)
+	}
+}
+
+func TestLoadLeavesArgs(t *testing.T) {
+	fs := flag.NewFlagSet("go-hana", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if _, err := Load(fs, append(required, "sync", "-once")); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(fs.Args(), " "); got != "sync -once" {
+		t.Errorf("Args() = %q, want the command and its arguments", got)
+	}
+}
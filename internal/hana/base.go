@@ -1,230 +1,350 @@
 package hana
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	_ "github.com/SAP/go-hdb/driver"
+	hdb "github.com/SAP/go-hdb/driver"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go-hana/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
+	"time"
 )
 
-const (
-	driverName = "hdb"
-)
+type Config struct {
+	URI string
+	// MaxOpenConns caps the number of connections to HANA. The pool is shared
+	// by all schedulers, so this is the global limit across entities. The
+	// watchdog and the probes use up to PROBE_CONNS more.
+	MaxOpenConns int
+	// MaxIdleConns is the number of idle connections kept open. It should
+	// match the number of workers, or connections are closed and reopened
+	// between documents. The default of database/sql applies if it is 0.
+	MaxIdleConns int
+	// ConnMaxLifetime and ConnMaxIdleTime close connections that are older
+	// or idle longer, connections are reused forever if they are 0.
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	// TracerProvider records a span for every statement. Statements are not
+	// traced if it is nil.
+	TracerProvider trace.TracerProvider
+}
+
+// PROBE_CONNS is the size of the pool of the watchdog and the probes.
+const PROBE_CONNS = 2
 
 type DB struct {
 	*sql.DB
+	// probe is a pool of its own for the watchdog and the probes, so workers
+	// holding every connection of the main pool do not make HANA look
+	// unavailable
+	probe *sql.DB
 }
 
-func NewHanaDB(uri string) (*DB, error) {
-	db, err := sql.Open(driverName, uri)
+// NewHanaDB connects to HANA and registers the statistics of its connection
+// pool with reg.
+func NewHanaDB(ctx context.Context, reg prometheus.Registerer, cfg Config) (*DB, error) {
+	connector, err := hdb.NewDSNConnector(cfg.URI)
 	if err != nil {
 		return nil, err
 	}
-	if err = db.Ping(); err != nil {
+	traced := tracedConnector{
+		Connector: connector,
+		tracer:    tracing.Provider(cfg.TracerProvider).Tracer(instrumentationName),
+	}
+	db := sql.OpenDB(traced)
+	if cfg.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+	if err = db.PingContext(ctx); err != nil {
+		_ = db.Close()
 		return nil, err
 	}
-	return &DB{db}, nil
+
+	probe := sql.OpenDB(traced)
+	probe.SetMaxOpenConns(PROBE_CONNS)
+	probe.SetMaxIdleConns(PROBE_CONNS)
+	probe.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+
+	// in use and idle connections, and the waits for a free one
+	reg.MustRegister(collectors.NewDBStatsCollector(db, "hana"))
+	return &DB{DB: db, probe: probe}, nil
 }
 
-func CreateTables(db *DB) error {
-	if err := CreateProductsTable(db); err != nil {
+// Probe returns the pool of the watchdog and the probes, which is not shared
+// with the workers.
+func (db *DB) Probe() *DB {
+	return &DB{DB: db.probe, probe: db.probe}
+}
+
+// Close closes both pools.
+func (db *DB) Close() error {
+	if err := db.probe.Close(); err != nil {
+		_ = db.DB.Close()
+		return err
+	}
+	return db.DB.Close()
+}
+
+func CreateTables(ctx context.Context, db *DB) error {
+	if err := createTable("PRODUCTS", CreateProductsTable)(ctx, db); err != nil {
 		return fmt.Errorf("failed to create products table: %v", err)
 	}
-	if err := CreateProductCategoriesTable(db); err != nil {
+	if err := createTable("PRODUCT_CATEGORIES", CreateProductCategoriesTable)(ctx, db); err != nil {
 		return fmt.Errorf("failed to create product categories table: %v", err)
 	}
-	if err := CreateProductCategoryCodesTable(db); err != nil {
+	if err := createTable("PRODUCT_CATEGORY_CODES", CreateProductCategoryCodesTable)(ctx, db); err != nil {
 		return fmt.Errorf("failed to create product category codes table: %v", err)
 	}
-	if err := CreateProductMonthlyInstallmentsTable(db); err != nil {
+	if err := createTable("PRODUCT_MONTHLY_INSTALLMENTS", CreateProductMonthlyInstallmentsTable)(ctx, db); err != nil {
 		return fmt.Errorf("failed to create product monthly installments table: %v", err)
 	}
-	if err := CreateProductPromosTable(db); err != nil {
+	if err := createTable("PRODUCT_PROMOS", CreateProductPromosTable)(ctx, db); err != nil {
 		return fmt.Errorf("failed to create product promos table: %v", err)
 	}
-	if err := CreateOffersTable(db); err != nil {
+	if err := createTable("OFFERS", CreateOffersTable)(ctx, db); err != nil {
 		return fmt.Errorf("failed to create offers table: %v", err)
 	}
-	if err := CreateShopsTable(db); err != nil {
+	if err := createTable("SHOPS", CreateShopsTable)(ctx, db); err != nil {
 		return fmt.Errorf("failed to create shops table: %v", err)
 	}
-	if err := CreateShopReviewsTable(db); err != nil {
+	if err := createTable("SHOP_REVIEWS", CreateShopReviewsTable)(ctx, db); err != nil {
 		return fmt.Errorf("failed to create shop reviews table: %v", err)
 	}
-	if err := CreateBrandsTable(db); err != nil {
+	if err := createTable("BRANDS", CreateBrandsTable)(ctx, db); err != nil {
 		return fmt.Errorf("failed to create brands table: %v", err)
 	}
-	if err := CreateCategoriesTable(db); err != nil {
+	if err := createTable("CATEGORIES", CreateCategoriesTable)(ctx, db); err != nil {
 		return fmt.Errorf("failed to create categories table: %v", err)
 	}
-	if err := CreateCategoryCodesTable(db); err != nil {
+	if err := createTable("CATEGORY_CODES", CreateCategoryCodesTable)(ctx, db); err != nil {
 		return fmt.Errorf("failed to create category codes table: %v", err)
 	}
 	return nil
 }
 
-func DropTables(db *DB) error {
-	if _, err := db.Exec("DROP TABLE PRODUCT_PROMOS"); err != nil {
+func DropTables(ctx context.Context, db *DB) error {
+	if err := dropTable("PRODUCT_PROMOS")(ctx, db); err != nil {
 		return fmt.Errorf("failed to drop product promos table: %v", err)
 	}
-	if _, err := db.Exec("DROP TABLE PRODUCT_MONTHLY_INSTALLMENTS"); err != nil {
+	if err := dropTable("PRODUCT_MONTHLY_INSTALLMENTS")(ctx, db); err != nil {
 		return fmt.Errorf("failed to drop product monthly installments table: %v", err)
 	}
-	if _, err := db.Exec("DROP TABLE PRODUCT_CATEGORY_CODES"); err != nil {
+	if err := dropTable("PRODUCT_CATEGORY_CODES")(ctx, db); err != nil {
 		return fmt.Errorf("failed to drop product category codes table: %v", err)
 	}
-	if _, err := db.Exec("DROP TABLE PRODUCT_CATEGORIES"); err != nil {
+	if err := dropTable("PRODUCT_CATEGORIES")(ctx, db); err != nil {
 		return fmt.Errorf("failed to drop product categories table: %v", err)
 	}
-	if _, err := db.Exec("DROP TABLE PRODUCTS"); err != nil {
+	if err := dropTable("PRODUCTS")(ctx, db); err != nil {
 		return fmt.Errorf("failed to drop products table: %v", err)
 	}
-	if _, err := db.Exec("DROP TABLE OFFERS"); err != nil {
+	if err := dropTable("OFFERS")(ctx, db); err != nil {
 		return fmt.Errorf("failed to drop offers table: %v", err)
 	}
-	if _, err := db.Exec("DROP TABLE SHOP_REVIEWS"); err != nil {
+	if err := dropTable("SHOP_REVIEWS")(ctx, db); err != nil {
 		return fmt.Errorf("failed to drop shop reviews table: %v", err)
 	}
-	if _, err := db.Exec("DROP TABLE SHOPS"); err != nil {
+	if err := dropTable("SHOPS")(ctx, db); err != nil {
 		return fmt.Errorf("failed to drop shops table: %v", err)
 	}
-	if _, err := db.Exec("DROP TABLE BRANDS"); err != nil {
+	if err := dropTable("BRANDS")(ctx, db); err != nil {
 		return fmt.Errorf("failed to drop brands table: %v", err)
 	}
-	if _, err := db.Exec("DROP TABLE CATEGORY_CODES"); err != nil {
+	if err := dropTable("CATEGORY_CODES")(ctx, db); err != nil {
 		return fmt.Errorf("failed to drop category codes table: %v", err)
 	}
-	if _, err := db.Exec("DROP TABLE CATEGORIES"); err != nil {
+	if err := dropTable("CATEGORIES")(ctx, db); err != nil {
 		return fmt.Errorf("failed to drop categories table: %v", err)
 	}
 	return nil
 }
 
-func CreateProductsTable(db *DB) error {
-	_, err := db.Exec("CREATE TABLE PRODUCTS (" +
-		"ID VARCHAR(255) NOT NULL PRIMARY KEY, " +
-		"ADJUSTED_RATING DOUBLE, " +
-		"BRAND_ID INTEGER, " +
-		"CATEGORY_ID INTEGER, " +
-		"CREATED_TIME VARCHAR(255), " +
-		"CREDIT_MONTHLY_PRICE DOUBLE, " +
-		"CURRENCY VARCHAR(255), " +
-		"DELIVERY_DURATION VARCHAR(255), " +
-		"DISCOUNT DOUBLE, " +
-		"HAS_VARIANTS BOOLEAN, " +
-		"LOAN_AVAILABLE BOOLEAN, " +
-		"RATING DOUBLE, " +
-		"REVIEWS_LINK VARCHAR(255), " +
-		"REVIEWS_QUANTITY INTEGER, " +
-		"LINK VARCHAR(255), " +
-		"TITLE VARCHAR(255), " +
-		"UNIT_PRICE DOUBLE, " +
-		"UNIT_SALE_PRICE DOUBLE, " +
-		"WEIGHT DOUBLE" +
+func CreateProductsTable(ctx context.Context, db *DB) error {
+	_, err := db.ExecContext(ctx, "CREATE TABLE PRODUCTS ("+
+		"ID VARCHAR(255) NOT NULL PRIMARY KEY, "+
+		"ADJUSTED_RATING DOUBLE, "+
+		"BRAND_ID INTEGER, "+
+		"CATEGORY_ID INTEGER, "+
+		"CREATED_TIME VARCHAR(255), "+
+		"CREDIT_MONTHLY_PRICE DOUBLE, "+
+		"CURRENCY VARCHAR(255), "+
+		"DELIVERY_DURATION VARCHAR(255), "+
+		"DISCOUNT DOUBLE, "+
+		"HAS_VARIANTS BOOLEAN, "+
+		"LOAN_AVAILABLE BOOLEAN, "+
+		"RATING DOUBLE, "+
+		"REVIEWS_LINK VARCHAR(255), "+
+		"REVIEWS_QUANTITY INTEGER, "+
+		"LINK VARCHAR(255), "+
+		"TITLE VARCHAR(255), "+
+		"UNIT_PRICE DOUBLE, "+
+		"UNIT_SALE_PRICE DOUBLE, "+
+		"WEIGHT DOUBLE"+
 		")")
 	return err
 }
 
-func CreateProductCategoriesTable(db *DB) error {
-	_, err := db.Exec("CREATE TABLE PRODUCT_CATEGORIES (" +
-		"PRODUCT_ID INTEGER NOT NULL, " +
-		"CATEGORY_ID INTEGER NOT NULL, " +
-		"PRIMARY KEY (PRODUCT_ID, CATEGORY_ID)" +
+func CreateProductCategoriesTable(ctx context.Context, db *DB) error {
+	_, err := db.ExecContext(ctx, "CREATE TABLE PRODUCT_CATEGORIES ("+
+		"PRODUCT_ID INTEGER NOT NULL, "+
+		"CATEGORY_ID INTEGER NOT NULL, "+
+		"PRIMARY KEY (PRODUCT_ID, CATEGORY_ID)"+
 		")")
 	return err
 }
 
-func CreateProductCategoryCodesTable(db *DB) error {
-	_, err := db.Exec("CREATE TABLE PRODUCT_CATEGORY_CODES (" +
-		"PRODUCT_ID INTEGER NOT NULL, " +
-		"CATEGORY_CODE_ID INTEGER NOT NULL, " +
-		"PRIMARY KEY (PRODUCT_ID, CATEGORY_CODE_ID)" +
+func CreateProductCategoryCodesTable(ctx context.Context, db *DB) error {
+	_, err := db.ExecContext(ctx, "CREATE TABLE PRODUCT_CATEGORY_CODES ("+
+		"PRODUCT_ID INTEGER NOT NULL, "+
+		"CATEGORY_CODE_ID INTEGER NOT NULL, "+
+		"PRIMARY KEY (PRODUCT_ID, CATEGORY_CODE_ID)"+
 		")")
 	return err
 }
 
-func CreateProductMonthlyInstallmentsTable(db *DB) error {
-	_, err := db.Exec("CREATE TABLE PRODUCT_MONTHLY_INSTALLMENTS (" +
-		"PRODUCT_ID INTEGER NOT NULL, " +
-		"INSTALLMENT_ID INTEGER NOT NULL, " +
-		"INSTALLMENT BOOLEAN, " +
-		"INSTALLMENT_PER_MONTH VARCHAR(255), " +
-		"PRIMARY KEY (PRODUCT_ID, INSTALLMENT_ID)" +
+func CreateProductMonthlyInstallmentsTable(ctx context.Context, db *DB) error {
+	_, err := db.ExecContext(ctx, "CREATE TABLE PRODUCT_MONTHLY_INSTALLMENTS ("+
+		"PRODUCT_ID INTEGER NOT NULL, "+
+		"INSTALLMENT_ID INTEGER NOT NULL, "+
+		"INSTALLMENT BOOLEAN, "+
+		"INSTALLMENT_PER_MONTH VARCHAR(255), "+
+		"PRIMARY KEY (PRODUCT_ID, INSTALLMENT_ID)"+
 		")")
 	return err
 }
 
-func CreateProductPromosTable(db *DB) error {
-	_, err := db.Exec("CREATE TABLE PRODUCT_PROMOS (" +
-		"PRODUCT_ID INTEGER NOT NULL, " +
-		"CODE VARCHAR(255), " +
-		"COMMENT VARCHAR(255), " +
-		"TYPE VARCHAR(255), " +
-		"PRIORITY INTEGER" +
+func CreateProductPromosTable(ctx context.Context, db *DB) error {
+	_, err := db.ExecContext(ctx, "CREATE TABLE PRODUCT_PROMOS ("+
+		"PRODUCT_ID INTEGER NOT NULL, "+
+		"CODE VARCHAR(255), "+
+		"COMMENT VARCHAR(255), "+
+		"TYPE VARCHAR(255), "+
+		"PRIORITY INTEGER"+
 		")")
 	return err
 }
 
-func CreateOffersTable(db *DB) error {
-	_, err := db.Exec("CREATE TABLE OFFERS (" +
-		"ID VARCHAR(255) NOT NULL PRIMARY KEY, " +
-		"PRODUCT_ID INTEGER, " +
-		"CATEGORY VARCHAR(255), " +
-		"SHOP_ID VARCHAR(255), " +
-		"AVAILABILITY_DATE VARCHAR(255), " +
-		"DELIVERY VARCHAR(255), " +
-		"DELIVERY_DURATION VARCHAR(255), " +
-		"KASPI_DELIVERY BOOLEAN, " +
-		"KD_DESTINATION_CITY VARCHAR(255), " +
-		"KD_PICKUP_DATE VARCHAR(255), " +
-		"LOCATED_IN_POINT VARCHAR(255), " +
-		"SHOP_RATING DOUBLE, " +
-		"SHOP_REVIEWS_QUANTITY INTEGER, " +
-		"PREORDER BOOLEAN, " +
-		"PRICE DOUBLE" +
+// addProductPromosKey keys PRODUCT_PROMOS by the position of the promo in
+// its product. The rows are removed, as the table holds duplicates from
+// earlier passes; the next pass loads them again.
+func addProductPromosKey(ctx context.Context, db *DB) error {
+	exists, err := constraintExists(ctx, db, "PRODUCT_PROMOS", "PRODUCT_PROMOS_PK")
+	if err != nil || exists {
+		return err
+	}
+	if _, err = db.ExecContext(ctx, "TRUNCATE TABLE PRODUCT_PROMOS"); err != nil {
+		return err
+	}
+	if err = addColumn("PRODUCT_PROMOS", "POSITION", "INTEGER NOT NULL")(ctx, db); err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "ALTER TABLE PRODUCT_PROMOS ADD CONSTRAINT PRODUCT_PROMOS_PK PRIMARY KEY (PRODUCT_ID, POSITION)")
+	return err
+}
+
+func dropProductPromosKey(ctx context.Context, db *DB) error {
+	exists, err := constraintExists(ctx, db, "PRODUCT_PROMOS", "PRODUCT_PROMOS_PK")
+	if err != nil {
+		return err
+	}
+	if exists {
+		if _, err = db.ExecContext(ctx, "ALTER TABLE PRODUCT_PROMOS DROP CONSTRAINT PRODUCT_PROMOS_PK"); err != nil {
+			return err
+		}
+	}
+	return dropColumn("PRODUCT_PROMOS", "POSITION")(ctx, db)
+}
+
+// hashedTables carry a ROW_HASH of their mapped values, so unchanged rows are
+// not written again.
+var hashedTables = []string{"PRODUCTS", "OFFERS", "SHOPS", "SHOP_REVIEWS"}
+
+func addRowHashes(ctx context.Context, db *DB) error {
+	for _, table := range hashedTables {
+		if err := addColumn(table, "ROW_HASH", "BIGINT")(ctx, db); err != nil {
+			return fmt.Errorf("failed to add row hash to %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+func dropRowHashes(ctx context.Context, db *DB) error {
+	for _, table := range hashedTables {
+		if err := dropColumn(table, "ROW_HASH")(ctx, db); err != nil {
+			return fmt.Errorf("failed to drop row hash of %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+func CreateOffersTable(ctx context.Context, db *DB) error {
+	_, err := db.ExecContext(ctx, "CREATE TABLE OFFERS ("+
+		"ID VARCHAR(255) NOT NULL PRIMARY KEY, "+
+		"PRODUCT_ID INTEGER, "+
+		"CATEGORY VARCHAR(255), "+
+		"SHOP_ID VARCHAR(255), "+
+		"AVAILABILITY_DATE VARCHAR(255), "+
+		"DELIVERY VARCHAR(255), "+
+		"DELIVERY_DURATION VARCHAR(255), "+
+		"KASPI_DELIVERY BOOLEAN, "+
+		"KD_DESTINATION_CITY VARCHAR(255), "+
+		"KD_PICKUP_DATE VARCHAR(255), "+
+		"LOCATED_IN_POINT VARCHAR(255), "+
+		"SHOP_RATING DOUBLE, "+
+		"SHOP_REVIEWS_QUANTITY INTEGER, "+
+		"PREORDER BOOLEAN, "+
+		"PRICE DOUBLE"+
 		")")
 	return err
 }
 
-func CreateShopsTable(db *DB) error {
-	_, err := db.Exec("CREATE TABLE SHOPS (" +
-		"ID VARCHAR(255) NOT NULL PRIMARY KEY, " +
-		"NAME VARCHAR(255)" +
+func CreateShopsTable(ctx context.Context, db *DB) error {
+	_, err := db.ExecContext(ctx, "CREATE TABLE SHOPS ("+
+		"ID VARCHAR(255) NOT NULL PRIMARY KEY, "+
+		"NAME VARCHAR(255)"+
 		")")
 	return err
 }
 
-func CreateShopReviewsTable(db *DB) error {
-	_, err := db.Exec("CREATE TABLE SHOP_REVIEWS (" +
-		"ID VARCHAR(255) NOT NULL PRIMARY KEY, " +
-		"SHOP_ID VARCHAR(255) NOT NULL, " +
-		"RATING DOUBLE, " +
-		"AUTHOR VARCHAR(255), " +
-		"COMMENT VARCHAR2(2000), " +
-		"DATE VARCHAR(255)" +
+func CreateShopReviewsTable(ctx context.Context, db *DB) error {
+	_, err := db.ExecContext(ctx, "CREATE TABLE SHOP_REVIEWS ("+
+		"ID VARCHAR(255) NOT NULL PRIMARY KEY, "+
+		"SHOP_ID VARCHAR(255) NOT NULL, "+
+		"RATING DOUBLE, "+
+		"AUTHOR VARCHAR(255), "+
+		"COMMENT VARCHAR2(2000), "+
+		"DATE VARCHAR(255)"+
 		")")
 	return err
 }
 
-func CreateBrandsTable(db *DB) error {
-	_, err := db.Exec("CREATE TABLE BRANDS (" +
-		"ID INTEGER NOT NULL PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY, " +
-		"NAME VARCHAR(255)" +
+func CreateBrandsTable(ctx context.Context, db *DB) error {
+	_, err := db.ExecContext(ctx, "CREATE TABLE BRANDS ("+
+		"ID INTEGER NOT NULL PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY, "+
+		"NAME VARCHAR(255)"+
 		")")
 	return err
 }
 
-func CreateCategoriesTable(db *DB) error {
-	_, err := db.Exec("CREATE TABLE CATEGORIES (" +
-		"ID INTEGER NOT NULL PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY, " +
-		"NAME VARCHAR(255)" +
+func CreateCategoriesTable(ctx context.Context, db *DB) error {
+	_, err := db.ExecContext(ctx, "CREATE TABLE CATEGORIES ("+
+		"ID INTEGER NOT NULL PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY, "+
+		"NAME VARCHAR(255)"+
 		")")
 	return err
 }
 
-func CreateCategoryCodesTable(db *DB) error {
-	_, err := db.Exec("CREATE TABLE CATEGORY_CODES (" +
-		"ID INTEGER NOT NULL PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY, " +
-		"CODE VARCHAR(255)" +
+func CreateCategoryCodesTable(ctx context.Context, db *DB) error {
+	_, err := db.ExecContext(ctx, "CREATE TABLE CATEGORY_CODES ("+
+		"ID INTEGER NOT NULL PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY, "+
+		"CODE VARCHAR(255)"+
 		")")
 	return err
 }
@@ -0,0 +1,129 @@
+package hana
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/SAP/go-hdb/driver"
+	"time"
+)
+
+// DeadLetter is a document that failed to load, recorded in ETL_DEAD_LETTERS.
+type DeadLetter struct {
+	Entity   string
+	SourceID string
+	// Document is the raw MongoDB document as extended JSON.
+	Document []byte
+	Stage    string
+	Error    string
+	// TraceID is the trace of the last failed attempt, empty if it was not
+	// traced.
+	TraceID       string
+	Attempts      int64
+	FirstFailedAt time.Time
+	LastFailedAt  time.Time
+}
+
+// SaveDeadLetter records a failed attempt to load a document. The attempt
+// count of a document that failed before is incremented.
+func SaveDeadLetter(ctx context.Context, db *DB, dl *DeadLetter) error {
+	errorMessage := truncate(dl.Error, 5000)
+
+	// update, if not exists then insert
+	res, err := db.ExecContext(ctx, "UPDATE ETL_DEAD_LETTERS SET DOCUMENT = ?, STAGE = ?, ERROR = ?, TRACE_ID = ?, "+
+		"ATTEMPTS = ATTEMPTS + 1, LAST_FAILED_AT = CURRENT_UTCTIMESTAMP WHERE ENTITY = ? AND SOURCE_ID = ?",
+		dl.Document, dl.Stage, errorMessage, nullString(dl.TraceID), dl.Entity, dl.SourceID)
+	if err != nil {
+		return fmt.Errorf("failed to update dead letter %s %s: %w", dl.Entity, dl.SourceID, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update dead letter %s %s: %w", dl.Entity, dl.SourceID, err)
+	}
+	if n > 0 {
+		return nil
+	}
+
+	if _, err = db.ExecContext(ctx, "INSERT INTO ETL_DEAD_LETTERS (ENTITY, SOURCE_ID, DOCUMENT, STAGE, ERROR, TRACE_ID, "+
+		"ATTEMPTS, FIRST_FAILED_AT, LAST_FAILED_AT) VALUES (?, ?, ?, ?, ?, ?, 1, CURRENT_UTCTIMESTAMP, CURRENT_UTCTIMESTAMP)",
+		dl.Entity, dl.SourceID, dl.Document, dl.Stage, errorMessage, nullString(dl.TraceID)); err != nil {
+		return fmt.Errorf("failed to insert dead letter %s %s: %w", dl.Entity, dl.SourceID, err)
+	}
+	return nil
+}
+
+// GetDeadLetters returns the dead letters of entity, or of all entities if
+// entity is empty, oldest first.
+func GetDeadLetters(ctx context.Context, db *DB, entity string) ([]*DeadLetter, error) {
+	rows, err := db.QueryContext(ctx, "SELECT ENTITY, SOURCE_ID, DOCUMENT, STAGE, ERROR, TRACE_ID, ATTEMPTS, "+
+		"FIRST_FAILED_AT, LAST_FAILED_AT FROM ETL_DEAD_LETTERS WHERE ? = '' OR ENTITY = ? ORDER BY FIRST_FAILED_AT", entity, entity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	var deadLetters []*DeadLetter
+	for rows.Next() {
+		dl := &DeadLetter{}
+		var document bytes.Buffer
+		var traceID sql.NullString
+		if err = rows.Scan(&dl.Entity, &dl.SourceID, driver.NewLob(nil, &document), &dl.Stage, &dl.Error,
+			&traceID, &dl.Attempts, &dl.FirstFailedAt, &dl.LastFailedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan dead letter: %w", err)
+		}
+		dl.Document = document.Bytes()
+		dl.TraceID = traceID.String
+		deadLetters = append(deadLetters, dl)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get dead letters: %w", err)
+	}
+	return deadLetters, nil
+}
+
+// ClearDeadLetter removes the dead letter of a document within tx, which
+// loads the document.
+func ClearDeadLetter(ctx context.Context, tx *sql.Tx, entity, sourceID string) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM ETL_DEAD_LETTERS WHERE ENTITY = ? AND SOURCE_ID = ?", entity, sourceID); err != nil {
+		return fmt.Errorf("failed to clear dead letter %s %s: %w", entity, sourceID, err)
+	}
+	return nil
+}
+
+// CountDeadLetters returns the number of dead letters of entity.
+func CountDeadLetters(ctx context.Context, db *DB, entity string) (int64, error) {
+	var count int64
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM ETL_DEAD_LETTERS WHERE ENTITY = ?", entity).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count dead letters of %s: %w", entity, err)
+	}
+	return count, nil
+}
+
+// DeleteDeadLetter removes the dead letter of a document that was loaded.
+func DeleteDeadLetter(ctx context.Context, db *DB, entity, sourceID string) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM ETL_DEAD_LETTERS WHERE ENTITY = ? AND SOURCE_ID = ?", entity, sourceID); err != nil {
+		return fmt.Errorf("failed to delete dead letter %s %s: %w", entity, sourceID, err)
+	}
+	return nil
+}
+
+func createDeadLettersTable(ctx context.Context, db *DB) error {
+	_, err := db.ExecContext(ctx, "CREATE TABLE ETL_DEAD_LETTERS ("+
+		"ENTITY VARCHAR(255) NOT NULL, "+
+		"SOURCE_ID VARCHAR(255) NOT NULL, "+
+		"DOCUMENT NCLOB, "+
+		"STAGE VARCHAR(32) NOT NULL, "+
+		"ERROR NVARCHAR(5000), "+
+		"ATTEMPTS INTEGER NOT NULL, "+
+		"FIRST_FAILED_AT TIMESTAMP NOT NULL, "+
+		"LAST_FAILED_AT TIMESTAMP NOT NULL, "+
+		"PRIMARY KEY (ENTITY, SOURCE_ID)"+
+		")")
+	return err
+}
+
+// nullString stores empty strings as NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
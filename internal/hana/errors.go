@@ -0,0 +1,47 @@
+package hana
+
+import (
+	"database/sql/driver"
+	"errors"
+	hdb "github.com/SAP/go-hdb/driver"
+	"net"
+)
+
+// transientCodes are the SQL error codes of HANA errors that may succeed
+// when the transaction is retried.
+var transientCodes = map[int]bool{
+	131: true, // transaction rolled back by lock wait timeout
+	133: true, // transaction rolled back by detected deadlock
+	139: true, // current operation cancelled by request and transaction rolled back
+	146: true, // resource busy and NOWAIT specified
+	613: true, // execution aborted by timeout
+}
+
+// IsTransient reports whether err is a HANA or connection error that may
+// succeed on retry. All other errors are permanent.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var hdbErr hdb.Error
+	if errors.As(err, &hdbErr) {
+		return transientCodes[hdbErr.Code()]
+	}
+	return false
+}
+
+// ErrorCode returns the SQL error code of the HANA error wrapped by err.
+func ErrorCode(err error) (int, bool) {
+	var hdbErr hdb.Error
+	if errors.As(err, &hdbErr) {
+		return hdbErr.Code(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,57 @@
+package hana
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	hdb "github.com/SAP/go-hdb/driver"
+	"net"
+	"testing"
+)
+
+// hdbError is a HANA error with a SQL error code.
+type hdbError struct {
+	code int
+}
+
+var _ hdb.Error = hdbError{}
+
+func (e hdbError) Error() string   { return fmt.Sprintf("SQL error %d", e.code) }
+func (e hdbError) NumError() int   { return 1 }
+func (e hdbError) SetIdx(idx int)  {}
+func (e hdbError) StmtNo() int     { return 0 }
+func (e hdbError) Code() int       { return e.code }
+func (e hdbError) Position() int   { return 0 }
+func (e hdbError) Level() int      { return 1 }
+func (e hdbError) Text() string    { return e.Error() }
+func (e hdbError) IsWarning() bool { return false }
+func (e hdbError) IsError() bool   { return true }
+func (e hdbError) IsFatal() bool   { return false }
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "bad connection", err: driver.ErrBadConn, want: true},
+		{name: "wrapped bad connection", err: fmt.Errorf("writing product: %w", driver.ErrBadConn), want: true},
+		{name: "network", err: &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset")}, want: true},
+		{name: "lock wait timeout", err: hdbError{code: 131}, want: true},
+		{name: "deadlock", err: fmt.Errorf("committing transaction: %w", hdbError{code: 133}), want: true},
+		{name: "execution timeout", err: hdbError{code: 613}, want: true},
+		{name: "unique constraint", err: hdbError{code: 301}, want: false},
+		{name: "syntax", err: hdbError{code: 257}, want: false},
+		{name: "cancelled context", err: context.Canceled, want: false},
+		{name: "other", err: errors.New("invalid document"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransient(tt.err); got != tt.want {
+				t.Errorf("IsTransient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package hana
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrFenced = errors.New("fencing token is stale")
+)
+
+type fencingTokenKey struct{}
+
+// WithFencingToken returns a context whose transactions are only committed
+// while token is the current fencing token in HANA.
+func WithFencingToken(ctx context.Context, token int64) context.Context {
+	return context.WithValue(ctx, fencingTokenKey{}, token)
+}
+
+// CheckFence verifies that the fencing token of ctx is still the current one
+// and share-locks it until tx ends, so a new leader can only take over once
+// the transactions of the old one are finished. It does nothing if ctx has no
+// fencing token.
+func CheckFence(ctx context.Context, tx *sql.Tx) error {
+	token, ok := ctx.Value(fencingTokenKey{}).(int64)
+	if !ok {
+		return nil
+	}
+
+	var current int64
+	if err := tx.QueryRowContext(ctx, "SELECT TOKEN FROM ETL_LEADER WHERE ID = 1 FOR SHARE LOCK").Scan(&current); err != nil {
+		return fmt.Errorf("failed to get fencing token: %w", err)
+	}
+	if current != token {
+		return ErrFenced
+	}
+	return nil
+}
+
+// Fence makes token the current fencing token. It waits for the transactions
+// holding the previous token and fails with ErrFenced if a newer token is
+// already in place.
+func Fence(ctx context.Context, db *DB, token int64, holder string) error {
+	res, err := db.ExecContext(ctx, "UPDATE ETL_LEADER SET TOKEN = ?, HOLDER = ? WHERE ID = 1 AND TOKEN < ?",
+		token, holder, token)
+	if err != nil {
+		return fmt.Errorf("failed to update fencing token: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update fencing token: %v", err)
+	}
+	if n == 0 {
+		return ErrFenced
+	}
+	return nil
+}
+
+func createLeaderFenceTable(ctx context.Context, db *DB) error {
+	exists, err := tableExists(ctx, db, "ETL_LEADER")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if _, err = db.ExecContext(ctx, "CREATE TABLE ETL_LEADER ("+
+			"ID INTEGER NOT NULL PRIMARY KEY, "+
+			"TOKEN BIGINT NOT NULL, "+
+			"HOLDER VARCHAR(255)"+
+			")"); err != nil {
+			return err
+		}
+	}
+	// the row is kept if a failed migration inserted it already
+	_, err = db.ExecContext(ctx, "INSERT INTO ETL_LEADER (ID, TOKEN) "+
+		"SELECT 1, 0 FROM DUMMY WHERE NOT EXISTS (SELECT 1 FROM ETL_LEADER WHERE ID = 1)")
+	return err
+}
@@ -0,0 +1,309 @@
+package hana
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration is a versioned change of the HANA schema. up and down skip the
+// changes that are made already, so a migration that failed halfway is
+// applied or reverted again by the next run.
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, db *DB) error
+	down    func(ctx context.Context, db *DB) error
+}
+
+// migrations must be kept in version order, new ones are appended.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create tables",
+		up:      CreateTables,
+		down:    DropTables,
+	},
+	{
+		version: 2,
+		name:    "create leader fence",
+		up:      createLeaderFenceTable,
+		down:    dropTable("ETL_LEADER"),
+	},
+	{
+		version: 3,
+		name:    "create etl runs",
+		up:      createTable("ETL_RUNS", createRunsTable),
+		down:    dropTable("ETL_RUNS"),
+	},
+	{
+		version: 4,
+		name:    "add product promos key",
+		up:      addProductPromosKey,
+		down:    dropProductPromosKey,
+	},
+	{
+		version: 5,
+		name:    "create etl dead letters",
+		up:      createTable("ETL_DEAD_LETTERS", createDeadLettersTable),
+		down:    dropTable("ETL_DEAD_LETTERS"),
+	},
+	{
+		version: 6,
+		name:    "add row hashes",
+		up:      addRowHashes,
+		down:    dropRowHashes,
+	},
+	{
+		version: 7,
+		name:    "add dead letter trace ids",
+		up:      addColumn("ETL_DEAD_LETTERS", "TRACE_ID", "VARCHAR(32)"),
+		down:    dropColumn("ETL_DEAD_LETTERS", "TRACE_ID"),
+	},
+}
+
+// LatestVersion is the schema version this build expects.
+func LatestVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Migrate applies all pending migrations in order. Every migration is applied
+// and recorded while SCHEMA_MIGRATIONS is locked, so processes migrating at
+// the same time take turns and skip what the others applied.
+func Migrate(ctx context.Context, db *DB) error {
+	if err := createMigrationsTable(ctx, db); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if err := withMigrationsLock(ctx, db, func(tx *sql.Tx) error {
+			applied, err := isApplied(ctx, tx, m.version)
+			if err != nil || applied {
+				return err
+			}
+			if err = m.up(ctx, db); err != nil {
+				return fmt.Errorf("failed to apply migration %d (%s): %v", m.version, m.name, err)
+			}
+			if _, err = tx.ExecContext(ctx, "INSERT INTO SCHEMA_MIGRATIONS (VERSION, NAME, APPLIED_AT) VALUES (?, ?, CURRENT_UTCTIMESTAMP)",
+				m.version, m.name); err != nil {
+				return fmt.Errorf("failed to record migration %d: %v", m.version, err)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rollback reverts the applied migrations after version, newest first. All
+// of them are reverted if version is 0.
+func Rollback(ctx context.Context, db *DB, version int) error {
+	if err := createMigrationsTable(ctx, db); err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version <= version {
+			continue
+		}
+		if err := withMigrationsLock(ctx, db, func(tx *sql.Tx) error {
+			applied, err := isApplied(ctx, tx, m.version)
+			if err != nil || !applied {
+				return err
+			}
+			if err = m.down(ctx, db); err != nil {
+				return fmt.Errorf("failed to revert migration %d (%s): %v", m.version, m.name, err)
+			}
+			if _, err = tx.ExecContext(ctx, "DELETE FROM SCHEMA_MIGRATIONS WHERE VERSION = ?", m.version); err != nil {
+				return fmt.Errorf("failed to record revert of migration %d: %v", m.version, err)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withMigrationsLock runs fn in a transaction that holds an exclusive lock on
+// SCHEMA_MIGRATIONS until it commits. HANA commits DDL right away, so the
+// changes of fn run on other connections of db and the pool needs at least two.
+func withMigrationsLock(ctx context.Context, db *DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin migration transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, "LOCK TABLE SCHEMA_MIGRATIONS IN EXCLUSIVE MODE"); err != nil {
+		return fmt.Errorf("failed to lock schema migrations: %v", err)
+	}
+	if err = fn(tx); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration transaction: %v", err)
+	}
+	return nil
+}
+
+func isApplied(ctx context.Context, tx *sql.Tx, version int) (bool, error) {
+	var count int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM SCHEMA_MIGRATIONS WHERE VERSION = ?", version).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to look up migration %d: %v", version, err)
+	}
+	return count > 0, nil
+}
+
+// MigrationState is a migration of this build and whether it is applied.
+type MigrationState struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	Applied bool   `json:"applied"`
+	// AppliedAt is zero if the migration is pending.
+	AppliedAt time.Time `json:"appliedAt"`
+}
+
+// MigrationStates returns the state of every migration in version order.
+func MigrationStates(ctx context.Context, db *DB) ([]MigrationState, error) {
+	if _, err := SchemaVersion(ctx, db); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT VERSION, APPLIED_AT FROM SCHEMA_MIGRATIONS")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %v", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt sql.NullTime
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan applied migration: %v", err)
+		}
+		applied[version] = appliedAt.Time
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %v", err)
+	}
+
+	states := make([]MigrationState, len(migrations))
+	for i, m := range migrations {
+		appliedAt, ok := applied[m.version]
+		states[i] = MigrationState{Version: m.version, Name: m.name, Applied: ok, AppliedAt: appliedAt}
+	}
+	return states, nil
+}
+
+// SchemaVersion returns the version of the last applied migration. It
+// creates the SCHEMA_MIGRATIONS table if needed. Schemas created before
+// migrations existed are at version 0 until Migrate records their tables.
+func SchemaVersion(ctx context.Context, db *DB) (int, error) {
+	if err := createMigrationsTable(ctx, db); err != nil {
+		return 0, err
+	}
+
+	var version int
+	if err := db.QueryRowContext(ctx, "SELECT IFNULL(MAX(VERSION), 0) FROM SCHEMA_MIGRATIONS").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to get schema version: %v", err)
+	}
+	return version, nil
+}
+
+func createMigrationsTable(ctx context.Context, db *DB) error {
+	exists, err := tableExists(ctx, db, "SCHEMA_MIGRATIONS")
+	if err != nil || exists {
+		return err
+	}
+	if _, err = db.ExecContext(ctx, "CREATE TABLE SCHEMA_MIGRATIONS ("+
+		"VERSION INTEGER NOT NULL PRIMARY KEY, "+
+		"NAME VARCHAR(255), "+
+		"APPLIED_AT TIMESTAMP"+
+		")"); err != nil {
+		// another process may have created it in the meantime
+		if exists, _ = tableExists(ctx, db, "SCHEMA_MIGRATIONS"); exists {
+			return nil
+		}
+		return fmt.Errorf("failed to create schema migrations table: %v", err)
+	}
+	return nil
+}
+
+func tableExists(ctx context.Context, db *DB, table string) (bool, error) {
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM SYS.TABLES WHERE SCHEMA_NAME = CURRENT_SCHEMA AND TABLE_NAME = ?",
+		table).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to look up table %s: %v", table, err)
+	}
+	return count > 0, nil
+}
+
+func columnExists(ctx context.Context, db *DB, table, column string) (bool, error) {
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM SYS.TABLE_COLUMNS WHERE SCHEMA_NAME = CURRENT_SCHEMA AND TABLE_NAME = ? AND COLUMN_NAME = ?",
+		table, column).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to look up column %s.%s: %v", table, column, err)
+	}
+	return count > 0, nil
+}
+
+func constraintExists(ctx context.Context, db *DB, table, constraint string) (bool, error) {
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM SYS.CONSTRAINTS WHERE SCHEMA_NAME = CURRENT_SCHEMA AND TABLE_NAME = ? AND CONSTRAINT_NAME = ?",
+		table, constraint).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to look up constraint %s of %s: %v", constraint, table, err)
+	}
+	return count > 0, nil
+}
+
+// createTable runs create unless table exists.
+func createTable(table string, create func(ctx context.Context, db *DB) error) func(ctx context.Context, db *DB) error {
+	return func(ctx context.Context, db *DB) error {
+		exists, err := tableExists(ctx, db, table)
+		if err != nil || exists {
+			return err
+		}
+		return create(ctx, db)
+	}
+}
+
+// dropTable drops table unless it is dropped already.
+func dropTable(table string) func(ctx context.Context, db *DB) error {
+	return func(ctx context.Context, db *DB) error {
+		exists, err := tableExists(ctx, db, table)
+		if err != nil || !exists {
+			return err
+		}
+		_, err = db.ExecContext(ctx, "DROP TABLE "+table)
+		return err
+	}
+}
+
+// addColumn adds column of type definition to table unless it exists.
+func addColumn(table, column, definition string) func(ctx context.Context, db *DB) error {
+	return func(ctx context.Context, db *DB) error {
+		exists, err := columnExists(ctx, db, table, column)
+		if err != nil || exists {
+			return err
+		}
+		_, err = db.ExecContext(ctx, "ALTER TABLE "+table+" ADD ("+column+" "+definition+")")
+		return err
+	}
+}
+
+// dropColumn drops column of table unless it is dropped already.
+func dropColumn(table, column string) func(ctx context.Context, db *DB) error {
+	return func(ctx context.Context, db *DB) error {
+		exists, err := columnExists(ctx, db, table, column)
+		if err != nil || !exists {
+			return err
+		}
+		_, err = db.ExecContext(ctx, "ALTER TABLE "+table+" DROP ("+column+")")
+		return err
+	}
+}
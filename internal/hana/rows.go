@@ -0,0 +1,86 @@
+package hana
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// maxIDsPerQuery bounds the IN list of a query by ID.
+const maxIDsPerQuery = 1000
+
+// CountRows returns the number of rows of table.
+func CountRows(ctx context.Context, db *DB, table string) (int64, error) {
+	var count int64
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count rows of %s: %v", table, err)
+	}
+	return count, nil
+}
+
+// ScanRows calls fn with the ID and the given columns of every row of table.
+func ScanRows(ctx context.Context, db *DB, table string, columns []string,
+	fn func(id string, values []interface{}) error) error {
+	query := "SELECT ID"
+	if len(columns) > 0 {
+		query += ", " + strings.Join(columns, ", ")
+	}
+	query += " FROM " + table
+	return scanRows(ctx, db, table, query, nil, len(columns), fn)
+}
+
+// ScanRowsByID calls fn with the ID and the given columns of the rows of
+// table whose ID is in ids. IDs without a row are skipped.
+func ScanRowsByID(ctx context.Context, db *DB, table string, columns []string, ids []string,
+	fn func(id string, values []interface{}) error) error {
+	query := "SELECT ID"
+	if len(columns) > 0 {
+		query += ", " + strings.Join(columns, ", ")
+	}
+	query += " FROM " + table + " WHERE ID IN ("
+
+	for start := 0; start < len(ids); start += maxIDsPerQuery {
+		end := start + maxIDsPerQuery
+		if end > len(ids) {
+			end = len(ids)
+		}
+		args := make([]interface{}, 0, end-start)
+		for _, id := range ids[start:end] {
+			args = append(args, id)
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+		if err := scanRows(ctx, db, table, query+placeholders+")", args, len(columns), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanRows(ctx context.Context, db *DB, table, query string, args []interface{}, columns int,
+	fn func(id string, values []interface{}) error) error {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to scan rows of %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		values := make([]interface{}, columns)
+		dest := make([]interface{}, 0, columns+1)
+		dest = append(dest, &id)
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return fmt.Errorf("failed to scan row of %s: %v", table, err)
+		}
+		if err = fn(id, values); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to scan rows of %s: %v", table, err)
+	}
+	return nil
+}
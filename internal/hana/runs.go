@@ -0,0 +1,128 @@
+package hana
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	// run modes
+	RUN_MODE_FULL     = "FULL"
+	RUN_MODE_RESUME   = "RESUME"
+	RUN_MODE_BACKFILL = "BACKFILL"
+
+	// run statuses
+	RUN_STATUS_RUNNING     = "RUNNING"
+	RUN_STATUS_SUCCEEDED   = "SUCCEEDED"
+	RUN_STATUS_PARTIAL     = "PARTIAL"
+	RUN_STATUS_FAILED      = "FAILED"
+	RUN_STATUS_INTERRUPTED = "INTERRUPTED"
+)
+
+// Run is a pass of this replica over an entity, recorded in ETL_RUNS.
+type Run struct {
+	ID         string    `json:"runId"`
+	Entity     string    `json:"entity"`
+	Mode       string    `json:"mode"`
+	Pass       int64     `json:"pass"`
+	Host       string    `json:"host"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Read       int64     `json:"read"`
+	Inserted   int64     `json:"inserted"`
+	Updated    int64     `json:"updated"`
+	Skipped    int64     `json:"skipped"`
+	Failed     int64     `json:"failed"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// SaveRun creates or updates the row of run.
+func SaveRun(ctx context.Context, db *DB, run *Run) error {
+	var finishedAt interface{}
+	if !run.FinishedAt.IsZero() {
+		finishedAt = run.FinishedAt.UTC()
+	}
+	var errorSummary interface{}
+	if run.Error != "" {
+		errorSummary = truncate(run.Error, 5000)
+	}
+
+	_, err := db.ExecContext(ctx, "UPSERT ETL_RUNS (RUN_ID, ENTITY, MODE, PASS, HOST, STARTED_AT, FINISHED_AT, DOCS_READ, "+
+		"DOCS_INSERTED, DOCS_UPDATED, DOCS_SKIPPED, DOCS_FAILED, STATUS, ERROR_SUMMARY) VALUES "+
+		"(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) WITH PRIMARY KEY",
+		run.ID, run.Entity, run.Mode, run.Pass, run.Host, run.StartedAt.UTC(), finishedAt, run.Read,
+		run.Inserted, run.Updated, run.Skipped, run.Failed, run.Status, errorSummary)
+	if err != nil {
+		return fmt.Errorf("failed to save run %s: %v", run.ID, err)
+	}
+	return nil
+}
+
+// GetRuns returns the last limit runs over entity, newest first.
+func GetRuns(ctx context.Context, db *DB, entity string, limit int) ([]*Run, error) {
+	rows, err := db.QueryContext(ctx, "SELECT RUN_ID, ENTITY, MODE, PASS, HOST, STARTED_AT, FINISHED_AT, DOCS_READ, "+
+		"DOCS_INSERTED, DOCS_UPDATED, DOCS_SKIPPED, DOCS_FAILED, STATUS, ERROR_SUMMARY FROM ETL_RUNS WHERE ENTITY = ? "+
+		"ORDER BY STARTED_AT DESC LIMIT ?", entity, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get runs of %s: %v", entity, err)
+	}
+	defer rows.Close()
+
+	var runs []*Run
+	for rows.Next() {
+		run := &Run{}
+		var pass, read, inserted, updated, skipped, failed sql.NullInt64
+		var host, errorSummary sql.NullString
+		var finishedAt sql.NullTime
+		if err = rows.Scan(&run.ID, &run.Entity, &run.Mode, &pass, &host, &run.StartedAt, &finishedAt, &read,
+			&inserted, &updated, &skipped, &failed, &run.Status, &errorSummary); err != nil {
+			return nil, fmt.Errorf("failed to scan run: %v", err)
+		}
+		run.Pass = pass.Int64
+		run.Host = host.String
+		run.FinishedAt = finishedAt.Time
+		run.Read = read.Int64
+		run.Inserted = inserted.Int64
+		run.Updated = updated.Int64
+		run.Skipped = skipped.Int64
+		run.Failed = failed.Int64
+		run.Error = errorSummary.String
+		runs = append(runs, run)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get runs of %s: %v", entity, err)
+	}
+	return runs, nil
+}
+
+func createRunsTable(ctx context.Context, db *DB) error {
+	_, err := db.ExecContext(ctx, "CREATE TABLE ETL_RUNS ("+
+		"RUN_ID VARCHAR(36) NOT NULL PRIMARY KEY, "+
+		"ENTITY VARCHAR(255) NOT NULL, "+
+		"MODE VARCHAR(32) NOT NULL, "+
+		"PASS BIGINT, "+
+		"HOST VARCHAR(255), "+
+		"STARTED_AT TIMESTAMP NOT NULL, "+
+		"FINISHED_AT TIMESTAMP, "+
+		"DOCS_READ BIGINT, "+
+		"DOCS_INSERTED BIGINT, "+
+		"DOCS_UPDATED BIGINT, "+
+		"DOCS_SKIPPED BIGINT, "+
+		"DOCS_FAILED BIGINT, "+
+		"STATUS VARCHAR(32) NOT NULL, "+
+		"ERROR_SUMMARY NVARCHAR(5000)"+
+		")")
+	return err
+}
+
+// truncate shortens s to at most n runes.
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n])
+}
@@ -0,0 +1,219 @@
+package hana
+
+import (
+	"context"
+	"database/sql/driver"
+	"go-hana/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// instrumentationName names the tracer of the HANA statements
+	instrumentationName = "go-hana/internal/hana"
+)
+
+// tracedConnector opens connections that record a span for every statement,
+// transaction commit and rollback. The spans are children of the span of the
+// statement's context, so they show up within the document they belong to.
+type tracedConnector struct {
+	driver.Connector
+	tracer trace.Tracer
+}
+
+func (c tracedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{conn: conn, tracer: c.tracer}, nil
+}
+
+// tracedConn passes everything on to the go-hdb connection. go-hdb runs
+// statements without arguments directly, the others are prepared and traced
+// by the prepared statement.
+type tracedConn struct {
+	conn   driver.Conn
+	tracer trace.Tracer
+}
+
+func (c *tracedConn) start(ctx context.Context, name, query string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{attribute.String("db.system", "hanadb")}
+	if query != "" {
+		attrs = append(attrs, attribute.String("db.statement", query))
+	}
+	return c.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func (c *tracedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *tracedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if p, ok := c.conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tracedStmt{Stmt: stmt, conn: c, query: query}, nil
+}
+
+func (c *tracedConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *tracedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *tracedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	var tx driver.Tx
+	var err error
+	if b, ok := c.conn.(driver.ConnBeginTx); ok {
+		tx, err = b.BeginTx(ctx, opts)
+	} else {
+		tx, err = c.conn.Begin()
+	}
+	if err != nil {
+		return nil, err
+	}
+	// commit and rollback get no context, their spans are children of the
+	// span the transaction was started in
+	return &tracedTx{Tx: tx, conn: c, ctx: ctx}, nil
+}
+
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.conn.(driver.ExecerContext)
+	if !ok || len(args) > 0 {
+		return nil, driver.ErrSkip
+	}
+	ctx, span := c.start(ctx, "hana.exec", query)
+	res, err := e.ExecContext(ctx, query, args)
+	endStatement(span, err)
+	return res, err
+}
+
+func (c *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.conn.(driver.QueryerContext)
+	if !ok || len(args) > 0 {
+		return nil, driver.ErrSkip
+	}
+	ctx, span := c.start(ctx, "hana.query", query)
+	rows, err := q.QueryContext(ctx, query, args)
+	endStatement(span, err)
+	return rows, err
+}
+
+func (c *tracedConn) Ping(ctx context.Context) error {
+	if p, ok := c.conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) IsValid() bool {
+	if v, ok := c.conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+// CheckNamedValue lets go-hdb convert its own argument types, like LOBs.
+func (c *tracedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type tracedStmt struct {
+	driver.Stmt
+	conn  *tracedConn
+	query string
+}
+
+func (s *tracedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	ctx, span := s.conn.start(ctx, "hana.exec", s.query)
+	var res driver.Result
+	var err error
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		res, err = e.ExecContext(ctx, args)
+	} else {
+		res, err = s.Stmt.Exec(values(args))
+	}
+	endStatement(span, err)
+	return res, err
+}
+
+func (s *tracedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	ctx, span := s.conn.start(ctx, "hana.query", s.query)
+	var rows driver.Rows
+	var err error
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = q.QueryContext(ctx, args)
+	} else {
+		rows, err = s.Stmt.Query(values(args))
+	}
+	endStatement(span, err)
+	return rows, err
+}
+
+func (s *tracedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// values converts args for statements of drivers without context support.
+func values(args []driver.NamedValue) []driver.Value {
+	vs := make([]driver.Value, len(args))
+	for i, arg := range args {
+		vs[i] = arg.Value
+	}
+	return vs
+}
+
+type tracedTx struct {
+	driver.Tx
+	conn *tracedConn
+	ctx  context.Context
+}
+
+func (t *tracedTx) Commit() error {
+	_, span := t.conn.start(t.ctx, "hana.commit", "")
+	err := t.Tx.Commit()
+	endStatement(span, err)
+	return err
+}
+
+func (t *tracedTx) Rollback() error {
+	_, span := t.conn.start(t.ctx, "hana.rollback", "")
+	err := t.Tx.Rollback()
+	endStatement(span, err)
+	return err
+}
+
+// endStatement ends the span of a statement. A statement skipped by go-hdb
+// is prepared and run again by database/sql, so it is not an error.
+func endStatement(span trace.Span, err error) {
+	if err == driver.ErrSkip {
+		err = nil
+	}
+	if code, ok := ErrorCode(err); ok {
+		span.SetAttributes(attribute.Int("db.hana.error_code", code))
+	}
+	tracing.End(span, err)
+}
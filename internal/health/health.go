@@ -0,0 +1,161 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-hana/internal/hana"
+	"go-hana/internal/mongodb"
+	"go-hana/internal/schedulers"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	STATUS_OK   = "ok"
+	STATUS_FAIL = "fail"
+)
+
+type Config struct {
+	// Timeout bounds the checks of a single probe.
+	Timeout time.Duration
+	// Staleness is how long a running pipeline may go without progress
+	// before it is considered wedged.
+	Staleness time.Duration
+}
+
+// Report is the response of a probe, with the result of every component.
+type Report struct {
+	Status     string               `json:"status"`
+	Components map[string]Component `json:"components"`
+}
+
+// Component is the result of checking a single dependency or pipeline.
+type Component struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Checker serves the probes of the Deployment:
+//
+//	/healthz fails if a pipeline is wedged, which a restart may fix
+//	/readyz  also fails while HANA or MongoDB is unavailable, or the HANA
+//	         schema is not at the expected version
+type Checker struct {
+	cfg      Config
+	mongoDB  *mongodb.DB
+	hanaDB   *hana.DB
+	controls schedulers.Controls
+	breaker  schedulers.Breaker
+}
+
+// New returns a checker of the pipelines of controls. Pipelines are not
+// considered wedged while breaker is tripped, as they wait for the databases.
+func New(mongoDB *mongodb.DB, hanaDB *hana.DB, controls schedulers.Controls, breaker schedulers.Breaker,
+	cfg Config) *Checker {
+	return &Checker{
+		cfg:      cfg,
+		mongoDB:  mongoDB,
+		hanaDB:   hanaDB,
+		controls: controls,
+		breaker:  breaker,
+	}
+}
+
+// Liveness returns the handler of /healthz.
+func (c *Checker) Liveness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := Report{Status: STATUS_OK, Components: make(map[string]Component)}
+		c.checkPipelines(&report)
+		write(w, report)
+	})
+}
+
+// Readiness returns the handler of /readyz.
+func (c *Checker) Readiness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), c.cfg.Timeout)
+		defer cancel()
+
+		report := Report{Status: STATUS_OK, Components: make(map[string]Component)}
+		checks := map[string]func(ctx context.Context) error{
+			"mongodb": func(ctx context.Context) error {
+				return c.mongoDB.Ping(ctx, readpref.Primary())
+			},
+			"hana":       c.hanaDB.Probe().PingContext,
+			"migrations": c.checkMigrations,
+		}
+
+		// the databases are checked concurrently, so a hanging one does not
+		// delay the other
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for name, check := range checks {
+			name, check := name, check
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := check(ctx)
+				mu.Lock()
+				defer mu.Unlock()
+				report.add(name, err)
+			}()
+		}
+		wg.Wait()
+		c.checkPipelines(&report)
+		write(w, report)
+	})
+}
+
+func (c *Checker) checkMigrations(ctx context.Context) error {
+	version, err := hana.SchemaVersion(ctx, c.hanaDB.Probe())
+	if err != nil {
+		return err
+	}
+	if latest := hana.LatestVersion(); version != latest {
+		return fmt.Errorf("schema is at version %d, expected %d", version, latest)
+	}
+	return nil
+}
+
+// checkPipelines fails the pipelines that are running but made no progress
+// within the staleness window. Paused, idle and waiting pipelines make no
+// progress on purpose.
+func (c *Checker) checkPipelines(report *Report) {
+	tripped := c.breaker != nil && c.breaker.Tripped()
+	for _, st := range c.controls.States() {
+		report.add("pipeline:"+st.Entity, c.checkPipeline(st, tripped))
+	}
+}
+
+func (c *Checker) checkPipeline(st schedulers.PipelineState, tripped bool) error {
+	if st.State != schedulers.STATE_RUNNING || st.Paused || tripped {
+		return nil
+	}
+	if since := time.Since(st.ProgressAt); since > c.cfg.Staleness {
+		return fmt.Errorf("no progress for %s", since.Round(time.Second))
+	}
+	return nil
+}
+
+func (r *Report) add(name string, err error) {
+	if err != nil {
+		r.Status = STATUS_FAIL
+		r.Components[name] = Component{Status: STATUS_FAIL, Error: err.Error()}
+		return
+	}
+	r.Components[name] = Component{Status: STATUS_OK}
+}
+
+func write(w http.ResponseWriter, report Report) {
+	status := http.StatusOK
+	if report.Status != STATUS_OK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	// the client went away if the response cannot be written
+	_ = json.NewEncoder(w).Encode(report)
+}
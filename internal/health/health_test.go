@@ -0,0 +1,99 @@
+package health
+
+import (
+	"encoding/json"
+	"go-hana/internal/schedulers"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckPipeline(t *testing.T) {
+	c := &Checker{cfg: Config{Staleness: time.Minute}}
+	recent := time.Now().Add(-time.Second)
+	stale := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name    string
+		st      schedulers.PipelineState
+		tripped bool
+		wantErr bool
+	}{
+		{name: "running", st: schedulers.PipelineState{State: schedulers.STATE_RUNNING, ProgressAt: recent}},
+		{name: "running without progress", st: schedulers.PipelineState{State: schedulers.STATE_RUNNING, ProgressAt: stale}, wantErr: true},
+		{name: "never progressed", st: schedulers.PipelineState{State: schedulers.STATE_RUNNING}, wantErr: true},
+		{name: "paused", st: schedulers.PipelineState{State: schedulers.STATE_RUNNING, Paused: true, ProgressAt: stale}},
+		{name: "breaker tripped", st: schedulers.PipelineState{State: schedulers.STATE_RUNNING, ProgressAt: stale}, tripped: true},
+		{name: "idle", st: schedulers.PipelineState{State: schedulers.STATE_IDLE, ProgressAt: stale}},
+		{name: "waiting", st: schedulers.PipelineState{State: schedulers.STATE_WAITING}},
+		{name: "stopped", st: schedulers.PipelineState{State: schedulers.STATE_STOPPED}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := c.checkPipeline(tt.st, tt.tripped); (err != nil) != tt.wantErr {
+				t.Errorf("checkPipeline() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReportAdd(t *testing.T) {
+	report := Report{Status: STATUS_OK, Components: make(map[string]Component)}
+	report.add("mongodb", nil)
+	if report.Status != STATUS_OK {
+		t.Errorf("status = %q after a passing check, want %q", report.Status, STATUS_OK)
+	}
+	report.add("hana", http.ErrHandlerTimeout)
+	report.add("migrations", nil)
+	if report.Status != STATUS_FAIL {
+		t.Errorf("status = %q after a failing check, want %q", report.Status, STATUS_FAIL)
+	}
+	if got := report.Components["hana"]; got.Status != STATUS_FAIL || got.Error == "" {
+		t.Errorf("hana = %+v, want a failure with its error", got)
+	}
+	if got := report.Components["migrations"]; got.Status != STATUS_OK {
+		t.Errorf("migrations = %+v, want %q", got, STATUS_OK)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	c := New(nil, nil, schedulers.NewControls(zap.NewNop()), nil, Config{Timeout: time.Second, Staleness: time.Minute})
+	rec := httptest.NewRecorder()
+	c.Liveness().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("status code = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var report Report
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range schedulers.EntityNames() {
+		if got := report.Components["pipeline:"+name]; got.Status != STATUS_OK {
+			t.Errorf("pipeline:%s = %+v, want %q for a stopped pipeline", name, got, STATUS_OK)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		status string
+		want   int
+	}{
+		{status: STATUS_OK, want: http.StatusOK},
+		{status: STATUS_FAIL, want: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			write(rec, Report{Status: tt.status})
+			if rec.Code != tt.want {
+				t.Errorf("status code = %d, want %d", rec.Code, tt.want)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+		})
+	}
+}
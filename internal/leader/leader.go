@@ -0,0 +1,148 @@
+package leader
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go-hana/internal/hana"
+	"go-hana/internal/mongodb"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	// Name is the name of the lease, shared by all replicas.
+	Name string
+	// Identity identifies this replica, e.g. the pod name.
+	Identity string
+	// LeaseDuration is how long the lease stays valid without renewal, so
+	// it bounds the time a standby needs to take over.
+	LeaseDuration time.Duration
+	// RenewInterval is how often the leader renews the lease and a standby
+	// tries to acquire it.
+	RenewInterval time.Duration
+}
+
+// Elector runs a function only while this replica holds the lease. The lease
+// lives in MongoDB, every acquisition gets a new fencing token, and the token
+// is installed in HANA, so the transactions of a stale leader are rejected.
+type Elector struct {
+	cfg      Config
+	lg       *zap.Logger
+	mongoDB  *mongodb.DB
+	hanaDB   *hana.DB
+	isLeader prometheus.Gauge
+
+	mu sync.Mutex
+	// leaderCtx is the context of the current leadership, it is nil while
+	// this replica is a standby
+	leaderCtx context.Context
+}
+
+func New(lg *zap.Logger, reg prometheus.Registerer, mongoDB *mongodb.DB, hanaDB *hana.DB, cfg Config) *Elector {
+	return &Elector{
+		cfg: cfg,
+		lg:  lg.With(zap.String("lease", cfg.Name)),
+		isLeader: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "leader",
+			Help: "Whether this replica is the leader (1) or a standby (0)",
+		}),
+		mongoDB: mongoDB,
+		hanaDB:  hanaDB,
+	}
+}
+
+// Run campaigns for the lease until ctx is cancelled. Whenever it is
+// acquired, lead is called with a context that carries the fencing token and
+// is cancelled when the lease is lost.
+func (e *Elector) Run(ctx context.Context, lead func(ctx context.Context)) {
+	for {
+		token, err := e.mongoDB.AcquireLease(ctx, e.cfg.Name, e.cfg.Identity, e.cfg.LeaseDuration)
+		if err != nil {
+			e.lg.Error("error while acquiring lease", zap.Error(err))
+		} else if token > 0 {
+			e.lg.Info("acquired lease", zap.Int64("token", token))
+			// waits until the transactions of the previous leader are finished
+			if err = hana.Fence(ctx, e.hanaDB, token, e.cfg.Identity); err != nil {
+				e.lg.Error("error while fencing", zap.Int64("token", token), zap.Error(err))
+			} else {
+				e.lead(ctx, token, lead)
+			}
+			e.release(token)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(e.cfg.RenewInterval):
+		}
+	}
+}
+
+// LeaderContext returns a context that carries the fencing token and is
+// cancelled when the lease is lost. It reports false while this replica is a
+// standby.
+func (e *Elector) LeaderContext() (context.Context, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leaderCtx, e.leaderCtx != nil
+}
+
+func (e *Elector) setLeaderContext(ctx context.Context) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.leaderCtx = ctx
+}
+
+func (e *Elector) lead(ctx context.Context, token int64, lead func(ctx context.Context)) {
+	e.isLeader.Set(1)
+	defer e.isLeader.Set(0)
+
+	leaderCtx, cancel := context.WithCancel(hana.WithFencingToken(ctx, token))
+	defer cancel()
+	e.setLeaderContext(leaderCtx)
+	defer e.setLeaderContext(nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lead(leaderCtx)
+	}()
+
+	ticker := time.NewTicker(e.cfg.RenewInterval)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		start := time.Now()
+		ok, err := e.mongoDB.RenewLease(ctx, e.cfg.Name, e.cfg.Identity, token, e.cfg.LeaseDuration)
+		if err == nil && ok {
+			renewed = start
+			continue
+		}
+		if err != nil && time.Since(renewed) < e.cfg.LeaseDuration {
+			e.lg.Warn("error while renewing lease", zap.Int64("token", token), zap.Error(err))
+			continue
+		}
+
+		e.lg.Warn("lost lease", zap.Int64("token", token), zap.Error(err))
+		cancel()
+		<-done
+		return
+	}
+}
+
+func (e *Elector) release(token int64) {
+	// ctx may be cancelled already on shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), e.cfg.RenewInterval)
+	defer cancel()
+	if err := e.mongoDB.ReleaseLease(ctx, e.cfg.Name, e.cfg.Identity, token); err != nil {
+		e.lg.Error("error while releasing lease", zap.Int64("token", token), zap.Error(err))
+	}
+}
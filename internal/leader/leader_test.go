@@ -0,0 +1,88 @@
+package leader
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"go-hana/internal/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func newElector(mongoDB *mongodb.DB, cfg Config) *Elector {
+	return New(zap.NewNop(), prometheus.NewRegistry(), mongoDB, nil, cfg)
+}
+
+// renewed is the response to renewing a lease that is still held.
+var renewed = mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1})
+
+// lead runs e.lead with a function that leads until its context is
+// cancelled, and returns how long it led.
+func lead(t *testing.T, e *Elector) time.Duration {
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.lead(context.Background(), 7, func(ctx context.Context) {
+			<-ctx.Done()
+		})
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("lead() did not return")
+	}
+	return time.Since(start)
+}
+
+func TestLeadUntilLeaseIsLost(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("taken over", func(mt *mtest.T) {
+		// the lease is renewed twice and then held by another replica
+		mt.AddMockResponses(renewed, renewed,
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0}))
+		e := newElector(&mongodb.DB{Client: mt.Client}, Config{LeaseDuration: time.Hour, RenewInterval: 10 * time.Millisecond})
+		if led := lead(t, e); led < 30*time.Millisecond {
+			t.Errorf("led for %s, want it to last until the third renewal", led)
+		}
+	})
+
+	mt.Run("renewal failing", func(mt *mtest.T) {
+		// a renewal that fails is retried until the lease expires
+		for i := 0; i < 20; i++ {
+			mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 91, Message: "shutting down"}))
+		}
+		leaseDuration := 100 * time.Millisecond
+		e := newElector(&mongodb.DB{Client: mt.Client}, Config{LeaseDuration: leaseDuration, RenewInterval: 10 * time.Millisecond})
+		if led := lead(t, e); led < leaseDuration {
+			t.Errorf("led for %s, want it to last for the lease duration of %s", led, leaseDuration)
+		}
+	})
+}
+
+func TestLeaderContext(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("leading", func(mt *mtest.T) {
+		e := newElector(&mongodb.DB{Client: mt.Client}, Config{LeaseDuration: time.Hour, RenewInterval: time.Hour})
+		if _, ok := e.LeaderContext(); ok {
+			t.Fatal("LeaderContext() reports a standby as the leader")
+		}
+
+		e.lead(context.Background(), 7, func(ctx context.Context) {
+			got, ok := e.LeaderContext()
+			if !ok || got != ctx {
+				t.Errorf("LeaderContext() = %v, %v while leading, want the context of the leadership", got, ok)
+			}
+		})
+
+		if _, ok := e.LeaderContext(); ok {
+			t.Error("LeaderContext() reports the leader after it stopped leading")
+		}
+	})
+}
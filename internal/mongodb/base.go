@@ -3,10 +3,14 @@ package mongodb
 import (
 	"context"
 	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go-hana/internal/tracing"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.opentelemetry.io/otel/trace"
+	"time"
 )
 
 const (
@@ -16,6 +20,13 @@ const (
 	OFFERS_COLLECTION       = "offers"
 	SHOPS_COLLECTION        = "shops"
 	SHOP_REVIEWS_COLLECTION = "shop_reviews"
+
+	// etl database, owned by go-hana itself
+	ETL_DATABASE           = "etl"
+	CHECKPOINTS_COLLECTION = "checkpoints"
+	LOCKS_COLLECTION       = "locks"
+	MEMBERS_COLLECTION     = "members"
+	RESYNC_COLLECTION      = "resync"
 )
 
 var (
@@ -25,14 +36,39 @@ var (
 
 type Config struct {
 	URI string
+	// MaxPoolSize and MinPoolSize bound the number of connections to every
+	// server, the defaults of the driver apply if they are 0.
+	MaxPoolSize uint64
+	MinPoolSize uint64
+	// MaxConnIdleTime is how long a connection may be idle before it is
+	// closed. Idle connections are kept if it is 0.
+	MaxConnIdleTime time.Duration
+	// TracerProvider records a span for every command of traced work.
+	// Commands are not traced if it is nil.
+	TracerProvider trace.TracerProvider
 }
 
 type DB struct {
 	*mongo.Client
 }
 
-func NewMongoDB(ctx context.Context, cfg Config) (*DB, error) {
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.URI))
+// NewMongoDB connects to MongoDB and registers the metrics of its connection
+// pools with reg.
+func NewMongoDB(ctx context.Context, reg prometheus.Registerer, cfg Config) (*DB, error) {
+	tracer := tracing.Provider(cfg.TracerProvider).Tracer(instrumentationName)
+	opts := options.Client().ApplyURI(cfg.URI).
+		SetMonitor(newCommandMonitor(tracer)).
+		SetPoolMonitor(newPoolMetrics(reg).monitor())
+	if cfg.MaxPoolSize > 0 {
+		opts.SetMaxPoolSize(cfg.MaxPoolSize)
+	}
+	if cfg.MinPoolSize > 0 {
+		opts.SetMinPoolSize(cfg.MinPoolSize)
+	}
+	if cfg.MaxConnIdleTime > 0 {
+		opts.SetMaxConnIdleTime(cfg.MaxConnIdleTime)
+	}
+	client, err := mongo.Connect(ctx, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -43,12 +79,8 @@ func NewMongoDB(ctx context.Context, cfg Config) (*DB, error) {
 }
 
 func (c DB) GetAll(ctx context.Context, databaseName, collectionName string, skip, limit int64) ([]map[string]interface{}, error) {
-	if databaseName != MAIN_DATABASE {
-		return nil, ErrDatabaseNotFound
-	}
-	if collectionName != PRODUCTS_COLLECTION && collectionName != OFFERS_COLLECTION &&
-		collectionName != SHOPS_COLLECTION && collectionName != SHOP_REVIEWS_COLLECTION {
-		return nil, ErrCollectionNotFound
+	if err := validate(databaseName, collectionName); err != nil {
+		return nil, err
 	}
 
 	findOptions := options.FindOptions{}
@@ -72,12 +104,38 @@ func (c DB) GetAll(ctx context.Context, databaseName, collectionName string, ski
 }
 
 func (c DB) GetCount(ctx context.Context, databaseName, collectionName string) (int64, error) {
+	if err := validate(databaseName, collectionName); err != nil {
+		return 0, err
+	}
+	return c.Database(databaseName).Collection(collectionName).CountDocuments(ctx, bson.M{})
+}
+
+// GetByIDs returns the documents with the given _ids, ordered by _id.
+func (c DB) GetByIDs(ctx context.Context, databaseName, collectionName string, ids []interface{}) ([]map[string]interface{}, error) {
+	if err := validate(databaseName, collectionName); err != nil {
+		return nil, err
+	}
+
+	findOptions := options.Find().SetSort(bson.M{"_id": 1})
+	cur, err := c.Database(databaseName).Collection(collectionName).Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []map[string]interface{}
+	if err = cur.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func validate(databaseName, collectionName string) error {
 	if databaseName != MAIN_DATABASE {
-		return 0, ErrDatabaseNotFound
+		return ErrDatabaseNotFound
 	}
 	if collectionName != PRODUCTS_COLLECTION && collectionName != OFFERS_COLLECTION &&
 		collectionName != SHOPS_COLLECTION && collectionName != SHOP_REVIEWS_COLLECTION {
-		return 0, ErrCollectionNotFound
+		return ErrCollectionNotFound
 	}
-	return c.Database(databaseName).Collection(collectionName).CountDocuments(ctx, bson.M{})
+	return nil
 }
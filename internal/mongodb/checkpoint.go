@@ -0,0 +1,79 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Checkpoint is the extraction progress of one pass over an entity. It is
+// shared by all replicas, which load different partitions of the same pass.
+type Checkpoint struct {
+	Entity     string      `bson:"_id"`
+	Pass       int64       `bson:"pass"`
+	Partitions []Partition `bson:"partitions"`
+}
+
+// Done reports whether all partitions of the pass are loaded.
+func (cp *Checkpoint) Done() bool {
+	for _, p := range cp.Partitions {
+		if !p.Done {
+			return false
+		}
+	}
+	return true
+}
+
+// GetCheckpoint returns the checkpoint of entity, or nil if there is none.
+func (c DB) GetCheckpoint(ctx context.Context, entity string) (*Checkpoint, error) {
+	var cp Checkpoint
+	err := c.checkpoints().FindOne(ctx, bson.M{"_id": entity}).Decode(&cp)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// StartPass replaces the checkpoint of the pass prev of cp.Entity with cp,
+// which must be the next pass. It returns false if another replica has
+// started the next pass already.
+func (c DB) StartPass(ctx context.Context, cp *Checkpoint, prev int64) (bool, error) {
+	if prev == 0 {
+		if _, err := c.checkpoints().InsertOne(ctx, cp); err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	}
+
+	res, err := c.checkpoints().ReplaceOne(ctx, bson.M{"_id": cp.Entity, "pass": prev}, cp)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// SavePartition stores the progress of the i-th partition of the given pass
+// over entity. Progress of a pass that is already replaced is dropped.
+func (c DB) SavePartition(ctx context.Context, entity string, pass int64, i int, p Partition) error {
+	_, err := c.checkpoints().UpdateOne(ctx, bson.M{"_id": entity, "pass": pass}, bson.M{
+		"$set": bson.M{fmt.Sprintf("partitions.%d", i): p},
+	})
+	return err
+}
+
+// DeleteCheckpoint removes the checkpoint of entity.
+func (c DB) DeleteCheckpoint(ctx context.Context, entity string) error {
+	_, err := c.checkpoints().DeleteOne(ctx, bson.M{"_id": entity})
+	return err
+}
+
+func (c DB) checkpoints() *mongo.Collection {
+	return c.Database(ETL_DATABASE).Collection(CHECKPOINTS_COLLECTION)
+}
@@ -0,0 +1,68 @@
+package mongodb
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// AcquireLease takes the lease name for holder if it is free or expired. It
+// returns the new fencing token, which grows with every acquisition, or 0 if
+// the lease is held by someone else. Expiry is computed with the clock of the
+// MongoDB server, so clock skew between replicas doesn't matter.
+func (c DB) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (int64, error) {
+	filter := bson.M{
+		"_id":   name,
+		"$expr": bson.M{"$lt": bson.A{"$expiresAt", "$$NOW"}},
+	}
+	update := bson.A{
+		bson.M{"$set": bson.M{
+			"holder":    holder,
+			"expiresAt": bson.M{"$add": bson.A{"$$NOW", ttl.Milliseconds()}},
+			"token":     bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$token", 0}}, 1}},
+		}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var lease struct {
+		Token int64 `bson:"token"`
+	}
+	err := c.locks().FindOneAndUpdate(ctx, filter, update, opts).Decode(&lease)
+	if err != nil {
+		// the lease exists and is not expired, so the upsert collides with it
+		if mongo.IsDuplicateKeyError(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return lease.Token, nil
+}
+
+// RenewLease extends the lease name held by holder with token. It returns
+// false if the lease was taken over in the meantime.
+func (c DB) RenewLease(ctx context.Context, name, holder string, token int64, ttl time.Duration) (bool, error) {
+	res, err := c.locks().UpdateOne(ctx, bson.M{"_id": name, "holder": holder, "token": token}, bson.A{
+		bson.M{"$set": bson.M{
+			"expiresAt": bson.M{"$add": bson.A{"$$NOW", ttl.Milliseconds()}},
+		}},
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// ReleaseLease expires the lease name held by holder with token, so another
+// replica can take it over right away.
+func (c DB) ReleaseLease(ctx context.Context, name, holder string, token int64) error {
+	_, err := c.locks().UpdateOne(ctx, bson.M{"_id": name, "holder": holder, "token": token}, bson.M{
+		"$set": bson.M{"expiresAt": time.Unix(0, 0)},
+	})
+	return err
+}
+
+func (c DB) locks() *mongo.Collection {
+	return c.Database(ETL_DATABASE).Collection(LOCKS_COLLECTION)
+}
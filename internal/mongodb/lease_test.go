@@ -0,0 +1,82 @@
+package mongodb
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"testing"
+	"time"
+)
+
+func TestAcquireLease(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("free", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{
+			{Key: "_id", Value: "go-hana"}, {Key: "holder", Value: "pod-a"}, {Key: "token", Value: int64(7)},
+		}}))
+		token, err := DB{mt.Client}.AcquireLease(context.Background(), "go-hana", "pod-a", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != 7 {
+			t.Errorf("AcquireLease() = %d, want 7", token)
+		}
+		cmd := mt.GetStartedEvent().Command
+		if upsert, _ := cmd.Lookup("upsert").BooleanOK(); !upsert {
+			t.Errorf("lease is not upserted: %v", cmd)
+		}
+	})
+
+	mt.Run("held", func(mt *mtest.T) {
+		// the upsert collides with the lease of another holder
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{Code: 11000, Message: "duplicate key"}))
+		token, err := DB{mt.Client}.AcquireLease(context.Background(), "go-hana", "pod-a", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != 0 {
+			t.Errorf("AcquireLease() = %d, want 0", token)
+		}
+	})
+
+	mt.Run("failed", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 91, Message: "shutting down"}))
+		if _, err := (DB{mt.Client}).AcquireLease(context.Background(), "go-hana", "pod-a", time.Minute); err == nil {
+			t.Error("AcquireLease() succeeded")
+		}
+	})
+}
+
+func TestRenewLease(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	tests := []struct {
+		name    string
+		matched int
+		want    bool
+	}{
+		{name: "held", matched: 1, want: true},
+		{name: "taken over", matched: 0, want: false},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(mtest.CreateSuccessResponse(
+				bson.E{Key: "n", Value: tt.matched}, bson.E{Key: "nModified", Value: tt.matched}))
+			ok, err := DB{mt.Client}.RenewLease(context.Background(), "go-hana", "pod-a", 7, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.want {
+				t.Errorf("RenewLease() = %v, want %v", ok, tt.want)
+			}
+			// only the holder of the current token may renew the lease
+			q := mt.GetStartedEvent().Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("q").Document()
+			if token, _ := q.Lookup("token").AsInt64OK(); token != 7 {
+				t.Errorf("renewed without the token: %v", q)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package mongodb
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// Heartbeat registers identity as a live member for ttl, measured with the
+// clock of the MongoDB server.
+func (c DB) Heartbeat(ctx context.Context, identity string, ttl time.Duration) error {
+	_, err := c.members().UpdateOne(ctx, bson.M{"_id": identity}, bson.A{
+		bson.M{"$set": bson.M{
+			"expiresAt": bson.M{"$add": bson.A{"$$NOW", ttl.Milliseconds()}},
+		}},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+// GetMembers returns the identities of the live members.
+func (c DB) GetMembers(ctx context.Context) ([]string, error) {
+	cur, err := c.members().Find(ctx, bson.M{
+		"$expr": bson.M{"$gt": bson.A{"$expiresAt", "$$NOW"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var members []struct {
+		ID string `bson:"_id"`
+	}
+	if err = cur.All(ctx, &members); err != nil {
+		return nil, err
+	}
+
+	identities := make([]string, 0, len(members))
+	for _, m := range members {
+		identities = append(identities, m.ID)
+	}
+	return identities, nil
+}
+
+// RemoveMember unregisters identity.
+func (c DB) RemoveMember(ctx context.Context, identity string) error {
+	_, err := c.members().DeleteOne(ctx, bson.M{"_id": identity})
+	return err
+}
+
+func (c DB) members() *mongo.Collection {
+	return c.Database(ETL_DATABASE).Collection(MEMBERS_COLLECTION)
+}
@@ -0,0 +1,154 @@
+package mongodb
+
+import (
+	"bytes"
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// samplesPerPartition is the number of random _ids sampled per partition
+	// to pick the partition boundaries
+	samplesPerPartition = 20
+)
+
+// Partition is an _id range [Lower, Upper) of a collection. A nil bound means
+// the range is unbounded on that side. Last is the _id of the last document
+// loaded from the partition, so extraction can resume after it.
+type Partition struct {
+	Lower interface{} `bson:"lower"`
+	Upper interface{} `bson:"upper"`
+	Last  interface{} `bson:"last"`
+	Done  bool        `bson:"done"`
+}
+
+// GetPartitions splits a collection into at most n _id ranges of roughly the
+// same size. The boundaries are picked from a random $sample of _ids.
+func (c DB) GetPartitions(ctx context.Context, databaseName, collectionName string, n int) ([]Partition, error) {
+	if err := validate(databaseName, collectionName); err != nil {
+		return nil, err
+	}
+	if n <= 1 {
+		return []Partition{{}}, nil
+	}
+
+	cur, err := c.Database(databaseName).Collection(collectionName).Aggregate(ctx, bson.A{
+		bson.M{"$sample": bson.M{"size": n * samplesPerPartition}},
+		bson.M{"$project": bson.M{"_id": 1}},
+		bson.M{"$sort": bson.M{"_id": 1}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []struct {
+		ID interface{} `bson:"_id"`
+	}
+	if err = cur.All(ctx, &samples); err != nil {
+		return nil, err
+	}
+
+	partitions := []Partition{{}}
+	for i := 1; i < n; i++ {
+		idx := i * len(samples) / n
+		if idx == 0 || idx >= len(samples) {
+			continue
+		}
+		bound := samples[idx].ID
+		last := &partitions[len(partitions)-1]
+		if last.Lower != nil && equalIDs(last.Lower, bound) {
+			continue
+		}
+		last.Upper = bound
+		partitions = append(partitions, Partition{Lower: bound})
+	}
+	return partitions, nil
+}
+
+// GetRange returns up to limit documents of the partition p that come after
+// p.Last, ordered by _id.
+func (c DB) GetRange(ctx context.Context, databaseName, collectionName string, p Partition, limit int64) ([]map[string]interface{}, error) {
+	if err := validate(databaseName, collectionName); err != nil {
+		return nil, err
+	}
+
+	id := bson.M{}
+	if p.Last != nil {
+		id["$gt"] = p.Last
+	} else if p.Lower != nil {
+		id["$gte"] = p.Lower
+	}
+	if p.Upper != nil {
+		id["$lt"] = p.Upper
+	}
+	filter := bson.M{}
+	if len(id) > 0 {
+		filter["_id"] = id
+	}
+
+	findOptions := options.Find().SetSort(bson.M{"_id": 1})
+	if limit > 0 {
+		findOptions.SetLimit(limit)
+	}
+
+	cur, err := c.Database(databaseName).Collection(collectionName).Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []map[string]interface{}
+	if err = cur.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// GetMatching returns up to limit documents matching filter that come after
+// the _id last, ordered by _id. All matching documents come after a nil last.
+func (c DB) GetMatching(ctx context.Context, databaseName, collectionName string, filter bson.M, last interface{},
+	limit int64) ([]map[string]interface{}, error) {
+	if err := validate(databaseName, collectionName); err != nil {
+		return nil, err
+	}
+
+	if last != nil {
+		filter = bson.M{"$and": bson.A{filter, bson.M{"_id": bson.M{"$gt": last}}}}
+	}
+	findOptions := options.Find().SetSort(bson.M{"_id": 1})
+	if limit > 0 {
+		findOptions.SetLimit(limit)
+	}
+
+	cur, err := c.Database(databaseName).Collection(collectionName).Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []map[string]interface{}
+	if err = cur.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// CountMatching returns the number of documents matching filter.
+func (c DB) CountMatching(ctx context.Context, databaseName, collectionName string, filter bson.M) (int64, error) {
+	if err := validate(databaseName, collectionName); err != nil {
+		return 0, err
+	}
+	return c.Database(databaseName).Collection(collectionName).CountDocuments(ctx, filter)
+}
+
+// equalIDs reports whether two _ids encode to the same BSON value.
+func equalIDs(a, b interface{}) bool {
+	ab, err := bson.Marshal(bson.M{"_id": a})
+	if err != nil {
+		return false
+	}
+	bb, err := bson.Marshal(bson.M{"_id": b})
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ab, bb)
+}
@@ -0,0 +1,90 @@
+package mongodb
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// poolMetrics follows the events of the connection pools of the client, one
+// pool per server address.
+type poolMetrics struct {
+	maxConnections *prometheus.GaugeVec
+	connections    *prometheus.GaugeVec
+	inUse          *prometheus.GaugeVec
+	waiting        *prometheus.GaugeVec
+	checkedOut     *prometheus.CounterVec
+	checkOutFailed *prometheus.CounterVec
+	closed         *prometheus.CounterVec
+	cleared        *prometheus.CounterVec
+}
+
+func newPoolMetrics(reg prometheus.Registerer) *poolMetrics {
+	factory := promauto.With(reg)
+	return &poolMetrics{
+		maxConnections: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mongodb_pool_max_connections",
+			Help: "The maximum number of connections of the pool",
+		}, []string{"address"}),
+		connections: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mongodb_pool_connections",
+			Help: "The number of open connections of the pool, in use or idle",
+		}, []string{"address"}),
+		inUse: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mongodb_pool_connections_in_use",
+			Help: "The number of connections checked out of the pool",
+		}, []string{"address"}),
+		waiting: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mongodb_pool_waiting",
+			Help: "The number of operations waiting to check out a connection",
+		}, []string{"address"}),
+		checkedOut: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "mongodb_pool_checkouts_total",
+			Help: "The total number of connections checked out of the pool",
+		}, []string{"address"}),
+		checkOutFailed: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "mongodb_pool_checkout_failures_total",
+			Help: "The total number of failed check outs, by the reason of the failure",
+		}, []string{"address", "reason"}),
+		closed: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "mongodb_pool_connections_closed_total",
+			Help: "The total number of connections closed, by the reason they were closed",
+		}, []string{"address", "reason"}),
+		cleared: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "mongodb_pool_cleared_total",
+			Help: "The total number of times the pool was cleared after a server error",
+		}, []string{"address"}),
+	}
+}
+
+// monitor returns the pool monitor of the client.
+func (m *poolMetrics) monitor() *event.PoolMonitor {
+	return &event.PoolMonitor{Event: m.record}
+}
+
+func (m *poolMetrics) record(e *event.PoolEvent) {
+	switch e.Type {
+	case event.PoolCreated:
+		if e.PoolOptions != nil {
+			m.maxConnections.WithLabelValues(e.Address).Set(float64(e.PoolOptions.MaxPoolSize))
+		}
+	case event.ConnectionCreated:
+		m.connections.WithLabelValues(e.Address).Inc()
+	case event.ConnectionClosed:
+		m.connections.WithLabelValues(e.Address).Dec()
+		m.closed.WithLabelValues(e.Address, e.Reason).Inc()
+	case event.GetStarted:
+		m.waiting.WithLabelValues(e.Address).Inc()
+	case event.GetSucceeded:
+		m.waiting.WithLabelValues(e.Address).Dec()
+		m.inUse.WithLabelValues(e.Address).Inc()
+		m.checkedOut.WithLabelValues(e.Address).Inc()
+	case event.GetFailed:
+		m.waiting.WithLabelValues(e.Address).Dec()
+		m.checkOutFailed.WithLabelValues(e.Address, e.Reason).Inc()
+	case event.ConnectionReturned:
+		m.inUse.WithLabelValues(e.Address).Dec()
+	case event.PoolCleared:
+		m.cleared.WithLabelValues(e.Address).Inc()
+	}
+}
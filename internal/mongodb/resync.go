@@ -0,0 +1,86 @@
+package mongodb
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// ResyncItem is a document queued to be loaded again, e.g. because the
+// reconciliation found it missing or different in HANA.
+type ResyncItem struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	Entity     string             `bson:"entity"`
+	SourceID   interface{}        `bson:"sourceId"`
+	Reason     string             `bson:"reason"`
+	EnqueuedAt time.Time          `bson:"enqueuedAt"`
+}
+
+// EnqueueResync queues the documents of entity with the given _ids. A
+// document that is queued already is queued only once.
+func (c DB) EnqueueResync(ctx context.Context, entity, reason string, ids []interface{}) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(ids))
+	now := time.Now()
+	for _, id := range ids {
+		filter := bson.M{"entity": entity, "sourceId": id}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpsert(true).SetUpdate(bson.M{
+			"$set":         bson.M{"reason": reason},
+			"$setOnInsert": bson.M{"enqueuedAt": now},
+		}))
+	}
+	_, err := c.resync().BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// GetResync returns up to limit queued documents of entity that come after
+// the item with the ID last, in the order they were queued. All of them come
+// after a nil last.
+func (c DB) GetResync(ctx context.Context, entity string, last interface{}, limit int64) ([]ResyncItem, error) {
+	filter := bson.M{"entity": entity}
+	if last != nil {
+		filter["_id"] = bson.M{"$gt": last}
+	}
+	findOptions := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(limit)
+	cur, err := c.resync().Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []ResyncItem
+	if err = cur.All(ctx, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// CountResync returns the number of queued documents of entity.
+func (c DB) CountResync(ctx context.Context, entity string) (int64, error) {
+	return c.resync().CountDocuments(ctx, bson.M{"entity": entity})
+}
+
+// DequeueResync removes the documents of entity with the given _ids from
+// the queue.
+func (c DB) DequeueResync(ctx context.Context, entity string, ids []interface{}) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := c.resync().DeleteMany(ctx, bson.M{"entity": entity, "sourceId": bson.M{"$in": ids}})
+	return err
+}
+
+// ClearResync removes the queued documents of all entities.
+func (c DB) ClearResync(ctx context.Context) error {
+	_, err := c.resync().DeleteMany(ctx, bson.M{})
+	return err
+}
+
+func (c DB) resync() *mongo.Collection {
+	return c.Database(ETL_DATABASE).Collection(RESYNC_COLLECTION)
+}
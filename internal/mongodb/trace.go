@@ -0,0 +1,65 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"go-hana/internal/tracing"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+)
+
+const (
+	// instrumentationName names the tracer of the MongoDB commands
+	instrumentationName = "go-hana/internal/mongodb"
+)
+
+// commandKey identifies a command in flight.
+type commandKey struct {
+	connectionID string
+	requestID    int64
+}
+
+// newCommandMonitor returns a monitor that records a span for every command
+// sent within a traced context. A cursor fetches its batches with getMore
+// commands, so every batch of a page gets a span of its own.
+func newCommandMonitor(tracer trace.Tracer) *event.CommandMonitor {
+	var spans sync.Map
+	finish := func(connectionID string, requestID int64, err error) {
+		if span, ok := spans.LoadAndDelete(commandKey{connectionID, requestID}); ok {
+			tracing.End(span.(trace.Span), err)
+		}
+	}
+
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			// commands of untraced work, like the leases, would start traces
+			// of their own
+			if !trace.SpanContextFromContext(ctx).IsValid() {
+				return
+			}
+			attrs := []attribute.KeyValue{
+				attribute.String("db.system", "mongodb"),
+				attribute.String("db.name", e.DatabaseName),
+				attribute.String("db.operation", e.CommandName),
+			}
+			collection, ok := e.Command.Lookup(e.CommandName).StringValueOK()
+			if !ok {
+				collection, ok = e.Command.Lookup("collection").StringValueOK()
+			}
+			if ok {
+				attrs = append(attrs, attribute.String("db.mongodb.collection", collection))
+			}
+			_, span := tracer.Start(ctx, "mongodb."+e.CommandName,
+				trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+			spans.Store(commandKey{e.ConnectionID, e.RequestID}, span)
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			finish(e.ConnectionID, e.RequestID, nil)
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			finish(e.ConnectionID, e.RequestID, errors.New(e.Failure))
+		},
+	}
+}
@@ -0,0 +1,185 @@
+package schedulers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-hana/internal/hana"
+	"go-hana/internal/mongodb"
+	"go-hana/internal/tracing"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"time"
+)
+
+// Backfill selects the documents of an entity to be loaded again. Exactly
+// one of IDs, the range From-To and Filter must be set.
+type Backfill struct {
+	Entity string `json:"entity"`
+	// IDs are the _ids of the documents.
+	IDs []interface{} `json:"ids,omitempty"`
+	// From and To bound the _ids of the documents to [From, To), a nil
+	// bound leaves the range open on that side.
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+	// Filter is a MongoDB query document.
+	Filter map[string]interface{} `json:"filter,omitempty"`
+}
+
+// BackfillReport is the result of a backfill, which is also recorded in
+// ETL_RUNS.
+type BackfillReport struct {
+	Entity   string `json:"entity"`
+	RunID    string `json:"runId"`
+	Status   string `json:"status"`
+	Read     int64  `json:"read"`
+	Inserted int64  `json:"inserted"`
+	Updated  int64  `json:"updated"`
+	Skipped  int64  `json:"skipped"`
+	Failed   int64  `json:"failed"`
+	Errors   string `json:"errors,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Validate checks that exactly one selector is set.
+func (b Backfill) Validate() error {
+	_, err := b.filter()
+	return err
+}
+
+func (b Backfill) filter() (bson.M, error) {
+	selectors := 0
+	filter := bson.M{}
+	if len(b.IDs) > 0 {
+		selectors++
+		filter["_id"] = bson.M{"$in": b.IDs}
+	}
+	if b.From != nil || b.To != nil {
+		selectors++
+		id := bson.M{}
+		if b.From != nil {
+			id["$gte"] = b.From
+		}
+		if b.To != nil {
+			id["$lt"] = b.To
+		}
+		filter["_id"] = id
+	}
+	if b.Filter != nil {
+		selectors++
+		filter = b.Filter
+	}
+	if selectors != 1 {
+		return nil, errors.New("exactly one of ids, an _id range and a filter must be given")
+	}
+	return filter, nil
+}
+
+// CountBackfill returns the number of documents selected by b.
+func CountBackfill(ctx context.Context, mongoDB *mongodb.DB, cfg Config, b Backfill) (int64, error) {
+	e, ok := entities[b.Entity]
+	if !ok {
+		return 0, fmt.Errorf("unknown entity %s", b.Entity)
+	}
+	filter, err := b.filter()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	err = withTimeout(ctx, cfg, e.name, operationRead, func(ctx context.Context) (err error) {
+		n, err = mongoDB.CountMatching(ctx, mongodb.MAIN_DATABASE, e.collection, filter)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("counting %s in MongoDB: %v", e.name, err)
+	}
+	return n, nil
+}
+
+// RunBackfill loads the documents selected by b through the same transform
+// and load code as the schedulers, and reports the results once all of them
+// are handled.
+func RunBackfill(ctx context.Context, mongoDB *mongodb.DB, hanaDB *hana.DB, cfg Config, b Backfill) (*BackfillReport, error) {
+	e, ok := entities[b.Entity]
+	if !ok {
+		return nil, fmt.Errorf("unknown entity %s", b.Entity)
+	}
+	filter, err := b.filter()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, span := cfg.tracer().Start(ctx, "run", trace.WithAttributes(attribute.String("entity", e.name),
+		attribute.String("mode", hana.RUN_MODE_BACKFILL)))
+	cfg = cfg.with(zap.String("entity", e.name), tracing.TraceField(ctx))
+	rec := newRunRecorder(ctx, hanaDB, cfg, e.name)
+	cfg = cfg.with(zap.String("run_id", rec.run.ID))
+	span.SetAttributes(attribute.String("run_id", rec.run.ID))
+	rec.start(hana.RUN_MODE_BACKFILL, 0)
+	cfg.logger().Info("starting backfill", zap.Any("filter", filter))
+
+	err = backfill(ctx, mongoDB, hanaDB, cfg, e, filter, rec.stats)
+	rec.finish(err, ctx.Err() != nil)
+	tracing.End(span, err)
+
+	run := rec.run
+	return &BackfillReport{
+		Entity:   run.Entity,
+		RunID:    run.ID,
+		Status:   run.Status,
+		Read:     run.Read,
+		Inserted: run.Inserted,
+		Updated:  run.Updated,
+		Skipped:  run.Skipped,
+		Failed:   run.Failed,
+		Errors:   run.Error,
+		Duration: run.FinishedAt.Sub(run.StartedAt).Round(time.Millisecond).String(),
+	}, err
+}
+
+func backfill(ctx context.Context, mongoDB *mongodb.DB, hanaDB *hana.DB, cfg Config, e entity, filter bson.M,
+	st *stats) error {
+	drainCtx, cancel := drainContext(ctx, cfg.GracePeriod)
+	defer cancel()
+	// closing the pool waits until the submitted documents are handled
+	pool := newWorkerPool(cfg.Workers, loader(drainCtx, hanaDB, cfg, e, st))
+	defer pool.close()
+	done := func(error) {}
+
+	var last interface{}
+	for {
+		if err := cfg.pause(ctx); err != nil {
+			return err
+		}
+
+		// the page span ends once the documents are handed over, they are
+		// only waited for when the pool is closed
+		pageCtx, span := cfg.tracer().Start(ctx, "page")
+		var docs []map[string]interface{}
+		err := withTimeout(pageCtx, cfg, e.name, operationRead, func(ctx context.Context) (err error) {
+			docs, err = mongoDB.GetMatching(ctx, mongodb.MAIN_DATABASE, e.collection, filter, last, int64(cfg.pageSize()))
+			return err
+		})
+		if err != nil {
+			tracing.End(span, err)
+			return fmt.Errorf("getting %s from MongoDB: %v", e.name, err)
+		}
+		st.addRead(len(docs))
+		span.SetAttributes(attribute.Int("documents", len(docs)))
+
+		for _, doc := range docs {
+			if err = pool.submit(pageCtx, doc, done); err != nil {
+				tracing.End(span, err)
+				return err
+			}
+		}
+		span.End()
+		if len(docs) < cfg.pageSize() {
+			return nil
+		}
+		last = docs[len(docs)-1]["_id"]
+	}
+}
@@ -0,0 +1,66 @@
+package schedulers
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"testing"
+)
+
+func TestBackfillFilter(t *testing.T) {
+	oid := primitive.NewObjectID()
+	tests := []struct {
+		name    string
+		b       Backfill
+		want    bson.M
+		wantErr bool
+	}{
+		{
+			name: "ids",
+			b:    Backfill{IDs: []interface{}{int32(1), "a", oid}},
+			want: bson.M{"_id": bson.M{"$in": []interface{}{int32(1), "a", oid}}},
+		},
+		{
+			name: "range",
+			b:    Backfill{From: int32(10), To: int32(20)},
+			want: bson.M{"_id": bson.M{"$gte": int32(10), "$lt": int32(20)}},
+		},
+		{
+			name: "range from",
+			b:    Backfill{From: oid},
+			want: bson.M{"_id": bson.M{"$gte": oid}},
+		},
+		{
+			name: "range to",
+			b:    Backfill{To: "m"},
+			want: bson.M{"_id": bson.M{"$lt": "m"}},
+		},
+		{
+			name: "filter",
+			b:    Backfill{Filter: map[string]interface{}{"shopId": "s1"}},
+			want: bson.M{"shopId": "s1"},
+		},
+		{name: "nothing", b: Backfill{}, wantErr: true},
+		{name: "empty ids", b: Backfill{IDs: []interface{}{}}, wantErr: true},
+		{name: "ids and range", b: Backfill{IDs: []interface{}{"a"}, From: "a"}, wantErr: true},
+		{
+			name:    "range and filter",
+			b:       Backfill{To: "m", Filter: map[string]interface{}{"shopId": "s1"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.b.filter()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("filter() error = %v, want error %v", err, tt.wantErr)
+			}
+			if verr := tt.b.Validate(); (verr != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %v", verr, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
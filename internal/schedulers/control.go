@@ -0,0 +1,260 @@
+package schedulers
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+const (
+	// pipeline states
+	STATE_STOPPED = "stopped"
+	STATE_WAITING = "waiting"
+	STATE_RUNNING = "running"
+	STATE_IDLE    = "idle"
+)
+
+// ErrNotRunning is returned when cancelling a pipeline without a running pass.
+var ErrNotRunning = errors.New("no pass is running")
+
+// Controls are the controls of the pipelines of all entities by name.
+type Controls map[string]*Control
+
+// NewControls returns a control for every entity.
+func NewControls(lg *zap.Logger) Controls {
+	controls := make(Controls, len(entities))
+	for name := range entities {
+		controls[name] = &Control{
+			name:    name,
+			lg:      lg.With(zap.String("entity", name)),
+			state:   STATE_STOPPED,
+			trigger: make(chan struct{}, 1),
+		}
+	}
+	return controls
+}
+
+// States returns the states of all pipelines, ordered by entity.
+func (c Controls) States() []PipelineState {
+	states := make([]PipelineState, 0, len(c))
+	for _, name := range EntityNames() {
+		if control, ok := c[name]; ok {
+			states = append(states, control.State())
+		}
+	}
+	return states
+}
+
+// PipelineState is a snapshot of the pipeline of an entity on this replica.
+type PipelineState struct {
+	Entity string `json:"entity"`
+	State  string `json:"state"`
+	Paused bool   `json:"paused"`
+	// Pass is the number of the running or the last pass.
+	Pass       int64     `json:"pass,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	LastError  string    `json:"lastError,omitempty"`
+	// ProgressAt is when the running pass last read or wrote a document, or
+	// read its checkpoint while waiting for the partitions of other replicas.
+	ProgressAt time.Time `json:"progressAt"`
+}
+
+// Control lets the pipeline of an entity be paused, resumed, triggered and
+// cancelled at runtime. Its methods may be called on a nil control, which
+// never pauses the pipeline.
+type Control struct {
+	name    string
+	lg      *zap.Logger
+	trigger chan struct{}
+
+	mu    sync.Mutex
+	state string
+	// resumed is closed when a paused pipeline is resumed, it is nil while
+	// the pipeline is not paused
+	resumed    chan struct{}
+	cancel     context.CancelFunc
+	cancelled  bool
+	pass       int64
+	startedAt  time.Time
+	finishedAt time.Time
+	lastError  string
+	progressAt time.Time
+}
+
+// State returns a snapshot of the pipeline.
+func (c *Control) State() PipelineState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return PipelineState{
+		Entity:     c.name,
+		State:      c.state,
+		Paused:     c.resumed != nil,
+		Pass:       c.pass,
+		StartedAt:  c.startedAt,
+		FinishedAt: c.finishedAt,
+		LastError:  c.lastError,
+		ProgressAt: c.progressAt,
+	}
+}
+
+// Pause stops the pipeline from reading and writing further documents until
+// it is resumed. The documents in flight are still written.
+func (c *Control) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resumed == nil {
+		c.resumed = make(chan struct{})
+		c.lg.Info("pipeline is paused")
+	}
+}
+
+// Resume continues a paused pipeline.
+func (c *Control) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resumed != nil {
+		close(c.resumed)
+		c.resumed = nil
+		c.lg.Info("pipeline is resumed")
+	}
+}
+
+// Sync starts the next pass of an idle pipeline right away. It has no effect
+// on a pass that is running already.
+func (c *Control) Sync() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Cancel stops the running pass. Its checkpoint is kept, and the pipeline
+// waits until it is triggered with Sync, which resumes the pass.
+func (c *Control) Cancel() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel == nil {
+		return ErrNotRunning
+	}
+	c.cancel()
+	c.cancelled = true
+	return nil
+}
+
+// wait blocks while the pipeline is paused.
+func (c *Control) wait(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	resumed := c.resumed
+	c.mu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// progress records that the pipeline is about to read or write documents.
+func (c *Control) progress() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.progressAt = time.Now()
+}
+
+func (c *Control) setState(state string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = state
+}
+
+// startPass returns the context of the next pass, which is cancelled by
+// Cancel.
+func (c *Control) startPass(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c == nil {
+		return context.WithCancel(ctx)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// a trigger sent while the previous pass was running is dropped
+	select {
+	case <-c.trigger:
+	default:
+	}
+	passCtx, cancel := context.WithCancel(ctx)
+	c.state = STATE_RUNNING
+	c.cancel = cancel
+	c.cancelled = false
+	c.startedAt = time.Now()
+	c.progressAt = c.startedAt
+	return passCtx, cancel
+}
+
+func (c *Control) setPass(pass int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pass = pass
+}
+
+// finishPass records the end of the pass and reports whether it was
+// cancelled by Cancel.
+func (c *Control) finishPass(err error) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancel = nil
+	c.finishedAt = time.Now()
+	c.lastError = ""
+	if err != nil {
+		c.lastError = err.Error()
+	}
+	return c.cancelled
+}
+
+// next blocks until the next pass is due, which is interval after the last
+// one or when the pipeline is triggered. A cancelled pipeline waits for the
+// trigger only.
+func (c *Control) next(ctx context.Context, interval time.Duration, cancelled bool) error {
+	var trigger chan struct{}
+	if c != nil {
+		trigger = c.trigger
+		c.setState(STATE_IDLE)
+		defer c.setState(STATE_WAITING)
+	}
+	var due <-chan time.Time
+	if !cancelled {
+		if interval <= 0 {
+			return nil
+		}
+		due = time.After(interval)
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-trigger:
+		return nil
+	case <-due:
+		return nil
+	}
+}
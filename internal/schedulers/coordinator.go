@@ -0,0 +1,176 @@
+package schedulers
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+)
+
+// Dependencies lists the entities every entity references by ID, which have
+// to be loaded first. The BRANDS, CATEGORIES and CATEGORY_CODES dimensions
+// of products are resolved while every product is loaded, so they need no
+// entry of their own.
+var Dependencies = map[string][]string{
+	OFFERS:       {SHOPS, PRODUCTS},
+	SHOP_REVIEWS: {SHOPS},
+}
+
+// Coordinator orders the passes of entities that depend on each other: the
+// n-th pass of an entity starts only after the n-th pass of every entity it
+// depends on has finished successfully. This holds for the initial full load
+// as well as for every reload after it, while independent entities run
+// concurrently.
+type Coordinator struct {
+	deps map[string][]string
+
+	mu       sync.Mutex
+	finished map[string]int64
+	changed  chan struct{}
+}
+
+// NewCoordinator returns a coordinator for dependencies, which must form a
+// directed acyclic graph.
+func NewCoordinator(dependencies map[string][]string) (*Coordinator, error) {
+	if cycle := findCycle(dependencies); cycle != nil {
+		return nil, fmt.Errorf("entity dependencies form a cycle: %v", cycle)
+	}
+	return &Coordinator{
+		deps:     dependencies,
+		finished: make(map[string]int64),
+		changed:  make(chan struct{}),
+	}, nil
+}
+
+// wait blocks until the dependencies of entity have finished as many passes
+// as entity is about to start.
+func (c *Coordinator) wait(ctx context.Context, lg *zap.Logger, entity string) error {
+	if c == nil {
+		return nil
+	}
+
+	logged := false
+	for {
+		c.mu.Lock()
+		next := c.finished[entity] + 1
+		var pending []string
+		for _, dep := range c.deps[entity] {
+			if c.finished[dep] < next {
+				pending = append(pending, dep)
+			}
+		}
+		changed := c.changed
+		c.mu.Unlock()
+
+		if len(pending) == 0 {
+			return nil
+		}
+		if !logged {
+			lg.Info("scheduler waits for its dependencies", zap.Int64("pass", next), zap.Strings("pending", pending))
+			logged = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// finish records a successful pass of entity and wakes up its dependents.
+func (c *Coordinator) finish(entity string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.finished[entity]++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// LoadOrder returns entities ordered so that every entity comes after the
+// entities it depends on. Independent entities are ordered by name.
+func LoadOrder(dependencies map[string][]string, entities []string) ([]string, error) {
+	if cycle := findCycle(dependencies); cycle != nil {
+		return nil, fmt.Errorf("entity dependencies form a cycle: %v", cycle)
+	}
+
+	sorted := append([]string{}, entities...)
+	sort.Strings(sorted)
+	included := make(map[string]bool, len(sorted))
+	for _, entity := range sorted {
+		included[entity] = true
+	}
+	added := make(map[string]bool, len(sorted))
+	order := make([]string, 0, len(sorted))
+	var add func(entity string)
+	add = func(entity string) {
+		if added[entity] {
+			return
+		}
+		added[entity] = true
+		for _, dep := range dependencies[entity] {
+			if included[dep] {
+				add(dep)
+			}
+		}
+		order = append(order, entity)
+	}
+	for _, entity := range sorted {
+		add(entity)
+	}
+	return order, nil
+}
+
+// findCycle returns the entities of a dependency cycle, or nil if there is
+// none.
+func findCycle(dependencies map[string][]string) []string {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var path []string
+
+	var visit func(entity string) []string
+	visit = func(entity string) []string {
+		switch state[entity] {
+		case visiting:
+			for i, e := range path {
+				if e == entity {
+					return append(append([]string{}, path[i:]...), entity)
+				}
+			}
+		case visited:
+			return nil
+		}
+
+		state[entity] = visiting
+		path = append(path, entity)
+		for _, dep := range dependencies[entity] {
+			if cycle := visit(dep); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		state[entity] = visited
+		return nil
+	}
+
+	// visit in a fixed order, so the reported cycle is stable
+	entities := make([]string, 0, len(dependencies))
+	for entity := range dependencies {
+		entities = append(entities, entity)
+	}
+	sort.Strings(entities)
+	for _, entity := range entities {
+		if cycle := visit(entity); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
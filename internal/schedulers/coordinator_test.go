@@ -0,0 +1,130 @@
+package schedulers
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFindCycle(t *testing.T) {
+	tests := []struct {
+		name         string
+		dependencies map[string][]string
+		want         []string
+	}{
+		{name: "none", dependencies: nil, want: nil},
+		{name: "declared", dependencies: Dependencies, want: nil},
+		{name: "chain", dependencies: map[string][]string{"a": {"b"}, "b": {"c"}}, want: nil},
+		{name: "diamond", dependencies: map[string][]string{"a": {"b", "c"}, "b": {"d"}, "c": {"d"}}, want: nil},
+		{name: "self", dependencies: map[string][]string{"a": {"a"}}, want: []string{"a", "a"}},
+		{name: "pair", dependencies: map[string][]string{"a": {"b"}, "b": {"a"}}, want: []string{"a", "b", "a"}},
+		{
+			name:         "behind a chain",
+			dependencies: map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"d"}, "d": {"b"}},
+			want:         []string{"b", "c", "d", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findCycle(tt.dependencies); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findCycle() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewCoordinatorRejectsCycles(t *testing.T) {
+	if _, err := NewCoordinator(map[string][]string{"a": {"b"}, "b": {"a"}}); err == nil {
+		t.Error("NewCoordinator() accepted a cycle")
+	}
+}
+
+func TestCoordinatorWait(t *testing.T) {
+	tests := []struct {
+		name string
+		// finished are the passes finished before entity waits
+		finished []string
+		entity   string
+		ready    bool
+	}{
+		{name: "no dependencies", entity: SHOPS, ready: true},
+		{name: "pending dependency", entity: SHOP_REVIEWS, ready: false},
+		{name: "finished dependency", finished: []string{SHOPS}, entity: SHOP_REVIEWS, ready: true},
+		{name: "one of two finished", finished: []string{SHOPS}, entity: OFFERS, ready: false},
+		{name: "both finished", finished: []string{SHOPS, PRODUCTS}, entity: OFFERS, ready: true},
+		{name: "next pass", finished: []string{SHOPS, SHOP_REVIEWS}, entity: SHOP_REVIEWS, ready: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewCoordinator(Dependencies)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entity := range tt.finished {
+				c.finish(entity)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			err = c.wait(ctx, zap.NewNop(), tt.entity)
+			if ready := err == nil; ready != tt.ready {
+				t.Errorf("wait() = %v, want ready %v", err, tt.ready)
+			}
+		})
+	}
+}
+
+func TestLoadOrder(t *testing.T) {
+	tests := []struct {
+		name         string
+		dependencies map[string][]string
+		entities     []string
+		want         []string
+		wantErr      bool
+	}{
+		{
+			name:         "all entities",
+			dependencies: Dependencies,
+			entities:     EntityNames(),
+			want:         []string{SHOPS, PRODUCTS, OFFERS, SHOP_REVIEWS},
+		},
+		{
+			name:         "dependencies left out",
+			dependencies: Dependencies,
+			entities:     []string{SHOP_REVIEWS, OFFERS},
+			want:         []string{OFFERS, SHOP_REVIEWS},
+		},
+		{
+			name:         "independent by name",
+			dependencies: nil,
+			entities:     []string{"c", "a", "b"},
+			want:         []string{"a", "b", "c"},
+		},
+		{
+			name:         "chain",
+			dependencies: map[string][]string{"a": {"b"}, "b": {"c"}},
+			entities:     []string{"a", "b", "c"},
+			want:         []string{"c", "b", "a"},
+		},
+		{name: "none", dependencies: Dependencies, entities: nil, want: []string{}},
+		{
+			name:         "cycle",
+			dependencies: map[string][]string{"a": {"b"}, "b": {"a"}},
+			entities:     []string{"a", "b"},
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LoadOrder(tt.dependencies, tt.entities)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadOrder() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadOrder() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
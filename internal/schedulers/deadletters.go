@@ -0,0 +1,133 @@
+package schedulers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-hana/internal/hana"
+	"go-hana/internal/mongodb"
+	"go-hana/internal/tracing"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
+)
+
+const (
+	// stages of loading a document, recorded with its dead letter
+	stageTransform = "transform"
+	stageResolve   = "resolve"
+	stageWrite     = "write"
+)
+
+// stageError is an error of a stage of loading a document.
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string { return e.err.Error() }
+func (e *stageError) Unwrap() error { return e.err }
+
+// deadLetter records that doc failed to load with err. Errors that are not
+// caused by the document itself, like a lost leadership, are not recorded.
+func deadLetter(ctx context.Context, hanaDB *hana.DB, cfg Config, e entity, doc map[string]interface{}, err error) {
+	if errors.Is(err, hana.ErrFenced) {
+		return
+	}
+	stage := stageWrite
+	var se *stageError
+	if errors.As(err, &se) {
+		stage = se.stage
+	}
+
+	document, merr := bson.MarshalExtJSON(doc, false, false)
+	if merr != nil {
+		cfg.logger().Error("error while converting document to JSON", documentField(doc), zap.Error(merr))
+	}
+	dl := &hana.DeadLetter{
+		Entity:   e.name,
+		SourceID: documentKey(doc),
+		Document: document,
+		Stage:    stage,
+		Error:    err.Error(),
+		TraceID:  tracing.TraceID(ctx),
+	}
+	if serr := withTimeout(ctx, cfg, e.name, operationCheckpoint, func(ctx context.Context) error {
+		return hana.SaveDeadLetter(ctx, hanaDB, dl)
+	}); serr != nil {
+		cfg.logger().Error("error while saving dead letter", append(errorFields(serr), documentField(doc))...)
+	}
+}
+
+// ReplayDeadLetters loads the documents of the dead letters of entity again,
+// or of all entities if entity is empty. The current version of every
+// document is read from MongoDB, so a replay never overwrites newer rows
+// with the snapshot taken when the document failed. The dead letters of
+// documents that are loaded or no longer exist are removed, the others are
+// recorded with another attempt. Documents are retried and timed out as set
+// by cfg.
+func ReplayDeadLetters(ctx context.Context, mongoDB *mongodb.DB, hanaDB *hana.DB, cfg Config,
+	entity string) (replayed, failed int, err error) {
+	if _, ok := entities[entity]; !ok && entity != "" {
+		return 0, 0, fmt.Errorf("unknown entity %s", entity)
+	}
+
+	ctx, span := cfg.tracer().Start(ctx, "replay")
+	defer func() {
+		tracing.End(span, err)
+	}()
+	cfg = cfg.with(tracing.TraceField(ctx))
+
+	deadLetters, err := hana.GetDeadLetters(ctx, hanaDB, entity)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, dl := range deadLetters {
+		if err = ctx.Err(); err != nil {
+			return replayed, failed, err
+		}
+		lg := cfg.logger().With(zap.String("entity", dl.Entity), zap.String("document_id", dl.SourceID))
+		e, ok := entities[dl.Entity]
+		if !ok {
+			lg.Warn("skipping dead letter of unknown entity")
+			continue
+		}
+		cfg := cfg.with(zap.String("entity", dl.Entity))
+
+		// the snapshot keeps the _id with its BSON type
+		var snapshot map[string]interface{}
+		if err = bson.UnmarshalExtJSON(dl.Document, false, &snapshot); err != nil {
+			lg.Error("error while converting dead letter", zap.Error(err))
+			failed++
+			continue
+		}
+		var docs []map[string]interface{}
+		err = withTimeout(ctx, cfg, e.name, operationRead, func(ctx context.Context) (err error) {
+			docs, err = mongoDB.GetByIDs(ctx, mongodb.MAIN_DATABASE, e.collection, []interface{}{snapshot["_id"]})
+			return err
+		})
+		if err != nil {
+			return replayed, failed, fmt.Errorf("getting %s from MongoDB: %v", e.name, err)
+		}
+		if len(docs) == 0 {
+			lg.Info("document no longer exists, removing its dead letter")
+			if err = hana.DeleteDeadLetter(ctx, hanaDB, dl.Entity, dl.SourceID); err != nil {
+				return replayed, failed, err
+			}
+			replayed++
+			continue
+		}
+
+		// the dead letter is removed along with the write
+		if _, err = load(ctx, hanaDB, cfg, e, docs[0]); err != nil {
+			if ctx.Err() != nil {
+				return replayed, failed, ctx.Err()
+			}
+			lg.Error("error while replaying dead letter", errorFields(err)...)
+			deadLetter(ctx, hanaDB, cfg, e, docs[0], err)
+			failed++
+			continue
+		}
+		replayed++
+	}
+	return replayed, failed, nil
+}
@@ -0,0 +1,106 @@
+package schedulers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go-hana/internal/hana"
+	"sync"
+)
+
+var (
+	brands        = newDimension("BRANDS", "NAME")
+	categories    = newDimension("CATEGORIES", "NAME")
+	categoryCodes = newDimension("CATEGORY_CODES", "CODE")
+)
+
+// dimension maps the values of a dimension table to their generated IDs.
+// Missing values are inserted in their own transaction, which checks the
+// fence like the writes of the records. Lookups of the same value are
+// serialized, so concurrent workers never insert it twice, while lookups of
+// different values run concurrently.
+type dimension struct {
+	table  string
+	column string
+
+	mu  sync.Mutex
+	ids map[string]int64
+	// locks serialize the lookups of values that are not cached yet
+	locks map[string]*sync.Mutex
+}
+
+func newDimension(table, column string) *dimension {
+	return &dimension{
+		table:  table,
+		column: column,
+		ids:    make(map[string]int64),
+		locks:  make(map[string]*sync.Mutex),
+	}
+}
+
+// id finds value in HANA, if not found, inserts it
+func (d *dimension) id(ctx context.Context, hanaDB *hana.DB, value string) (int64, error) {
+	d.mu.Lock()
+	if id, ok := d.ids[value]; ok {
+		d.mu.Unlock()
+		return id, nil
+	}
+	lock, ok := d.locks[value]
+	if !ok {
+		lock = &sync.Mutex{}
+		d.locks[value] = lock
+	}
+	d.mu.Unlock()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	// another worker may have looked it up while this one waited
+	d.mu.Lock()
+	id, ok := d.ids[value]
+	d.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	query := fmt.Sprintf("SELECT ID FROM %s WHERE %s = ?", d.table, d.column)
+	if err := hanaDB.QueryRowContext(ctx, query, value).Scan(&id); err != nil {
+		if err != sql.ErrNoRows {
+			return 0, err
+		}
+
+		if err = d.insert(ctx, hanaDB, value); err != nil {
+			return 0, err
+		}
+		if err = hanaDB.QueryRowContext(ctx, query, value).Scan(&id); err != nil {
+			return 0, err
+		}
+	}
+
+	d.mu.Lock()
+	d.ids[value] = id
+	// the waiting workers find it cached
+	delete(d.locks, value)
+	d.mu.Unlock()
+	return id, nil
+}
+
+// insert adds value unless this replica is fenced off.
+func (d *dimension) insert(ctx context.Context, hanaDB *hana.DB, value string) error {
+	tx, err := hanaDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err = hana.CheckFence(ctx, tx); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) VALUES (?)", d.table, d.column), value); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package schedulers
+
+import (
+	"context"
+	"fmt"
+	"go-hana/internal/hana"
+	"go-hana/internal/mongodb"
+	"sort"
+)
+
+// DiffReport is the effect that loading an entity would have on HANA,
+// computed by a dry run without writing.
+type DiffReport struct {
+	Entity string `json:"entity"`
+	Read   int64  `json:"read"`
+	// Invalid is the number of documents that cannot be transformed.
+	Invalid   int64 `json:"invalid"`
+	Unchanged int64 `json:"unchanged"`
+	// Inserts are the IDs of the rows that would be inserted.
+	Inserts []string  `json:"inserts"`
+	Updates []RowDiff `json:"updates"`
+	// Orphans are the IDs of the rows without a document, they would be
+	// left behind by the load.
+	Orphans []string `json:"orphans"`
+	// the number of rows of each kind, which may be more than listed
+	InsertCount int `json:"insertCount"`
+	UpdateCount int `json:"updateCount"`
+	OrphanCount int `json:"orphanCount"`
+}
+
+// RowDiff lists the columns of a row that would be updated.
+type RowDiff struct {
+	ID      string       `json:"id"`
+	Columns []ColumnDiff `json:"columns"`
+}
+
+// ColumnDiff is the value of a column before and after the update.
+type ColumnDiff struct {
+	Column string `json:"column"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// DryRun extracts and transforms the documents of an entity as a pass would,
+// but compares the results to the current rows in HANA instead of writing.
+// Only the columns of the entity's table are compared, the rows of its child
+// tables are not.
+func DryRun(ctx context.Context, mongoDB *mongodb.DB, hanaDB *hana.DB, cfg Config, name string) (*DiffReport, error) {
+	e, ok := entities[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown entity %s", name)
+	}
+	report := &DiffReport{Entity: name}
+
+	// compare the collection bucket by bucket, so only the documents and
+	// rows of one bucket are held in memory, along with the IDs of all
+	// documents that tell the orphans apart. The _id order of MongoDB differs
+	// from the ID order of HANA for numbers and ObjectIDs, so the rows are
+	// looked up by the IDs of the documents rather than by range.
+	var buckets []mongodb.Partition
+	err := withTimeout(ctx, cfg, name, operationRead, func(ctx context.Context) (err error) {
+		buckets, err = mongoDB.GetPartitions(ctx, mongodb.MAIN_DATABASE, e.collection, cfg.Partitions)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("splitting %s into buckets: %v", name, err)
+	}
+	seen := make(map[string]struct{})
+	for _, b := range buckets {
+		if err = diffBucket(ctx, mongoDB, hanaDB, cfg, e, b, seen, report); err != nil {
+			return nil, err
+		}
+	}
+
+	// the rows left have no document
+	if err = hana.ScanRows(ctx, hanaDB, e.table, nil, func(id string, _ []interface{}) error {
+		if _, ok := seen[id]; !ok {
+			report.OrphanCount++
+			report.Orphans = appendID(report.Orphans, id)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(report.Inserts)
+	sort.Strings(report.Orphans)
+	sort.Slice(report.Updates, func(i, j int) bool {
+		return report.Updates[i].ID < report.Updates[j].ID
+	})
+	return report, nil
+}
+
+func diffBucket(ctx context.Context, mongoDB *mongodb.DB, hanaDB *hana.DB, cfg Config, e entity, b mongodb.Partition,
+	seen map[string]struct{}, report *DiffReport) error {
+	// compare the transformed documents of the bucket to their rows
+	after := make(map[string][]interface{})
+	read, invalid, err := scanBucket(ctx, mongoDB, hanaDB, cfg, e, b, seen,
+		func(id string, _ interface{}, values []interface{}) {
+			after[id] = values
+		},
+		func(id string, before []interface{}) error {
+			values := after[id]
+			delete(after, id)
+
+			diff := RowDiff{ID: id}
+			for i, column := range e.columns {
+				if was, now := normalize(before[i]), normalize(values[i]); was != now {
+					diff.Columns = append(diff.Columns, ColumnDiff{Column: column, Before: was, After: now})
+				}
+			}
+			if len(diff.Columns) == 0 {
+				report.Unchanged++
+				return nil
+			}
+			report.UpdateCount++
+			if len(report.Updates) < maxReportedIDs {
+				report.Updates = append(report.Updates, diff)
+			}
+			return nil
+		})
+	report.Read += read
+	report.Invalid += invalid
+	if err != nil {
+		return err
+	}
+
+	// the documents left have no row yet
+	for id := range after {
+		report.InsertCount++
+		report.Inserts = appendID(report.Inserts, id)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package schedulers
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math"
+	"strconv"
+	"time"
+)
+
+// rowHash hashes the mapped values of a row. Values are normalized first, so
+// a value read from MongoDB and the same value read back from HANA have the
+// same hash.
+func rowHash(values []interface{}) uint64 {
+	h := sha256.New()
+	for _, v := range values {
+		_, _ = h.Write([]byte(normalize(v)))
+		_, _ = h.Write([]byte{0x1f})
+	}
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+func normalize(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case *string:
+		if v == nil {
+			return ""
+		}
+		return *v
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.FormatInt(int64(v), 10)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float32:
+		return normalizeFloat(float64(v))
+	case float64:
+		return normalizeFloat(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case primitive.DateTime:
+		return v.Time().UTC().Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// normalizeFloat formats whole numbers like integers, so a DOUBLE read back
+// from HANA matches the integer it was written from. Integers are not passed
+// through float64, which would make those above 2^53 collide.
+func normalizeFloat(f float64) string {
+	if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,72 @@
+package schedulers
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+	"time"
+)
+
+func TestNormalize(t *testing.T) {
+	s := "Almaty"
+	var nilString *string
+	at := time.Date(2022, 9, 1, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{name: "nil", value: nil, want: ""},
+		{name: "string", value: "Almaty", want: "Almaty"},
+		{name: "string pointer", value: &s, want: "Almaty"},
+		{name: "nil string pointer", value: nilString, want: ""},
+		{name: "bytes", value: []byte("Almaty"), want: "Almaty"},
+		{name: "bool", value: true, want: "true"},
+		{name: "int", value: 42, want: "42"},
+		{name: "int32", value: int32(42), want: "42"},
+		{name: "int64", value: int64(42), want: "42"},
+		{name: "float32", value: float32(1.5), want: "1.5"},
+		{name: "whole float64", value: float64(42), want: "42"},
+		{name: "float64", value: 4.99, want: "4.99"},
+		{name: "large int64", value: int64(1<<53 + 1), want: "9007199254740993"},
+		{name: "large whole float64", value: 1e18, want: "1000000000000000000"},
+		{name: "huge float64", value: 1e300, want: "1e+300"},
+		{name: "time", value: at, want: "2022-09-01T12:30:00Z"},
+		{name: "time in another zone", value: at.In(time.FixedZone("ALMT", 6*60*60)), want: "2022-09-01T12:30:00Z"},
+		{name: "date time", value: primitive.NewDateTimeFromTime(at), want: "2022-09-01T12:30:00Z"},
+		{name: "other", value: []int{1, 2}, want: "[1 2]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalize(tt.value); got != tt.want {
+				t.Errorf("normalize(%#v) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRowHash(t *testing.T) {
+	s := "Almaty"
+	tests := []struct {
+		name  string
+		a, b  []interface{}
+		equal bool
+	}{
+		{name: "same values", a: []interface{}{"a", 1}, b: []interface{}{"a", 1}, equal: true},
+		// what MongoDB returns and what HANA returns for the same row
+		{name: "number types", a: []interface{}{int32(7), 2.0}, b: []interface{}{int64(7), float32(2)}, equal: true},
+		{name: "string pointer", a: []interface{}{&s}, b: []interface{}{"Almaty"}, equal: true},
+		{name: "null", a: []interface{}{nil}, b: []interface{}{""}, equal: true},
+		{name: "int64 above 2^53", a: []interface{}{int64(1 << 53)}, b: []interface{}{int64(1<<53 + 1)}, equal: false},
+		{name: "changed value", a: []interface{}{"a", 1}, b: []interface{}{"a", 2}, equal: false},
+		{name: "swapped values", a: []interface{}{"a", "b"}, b: []interface{}{"b", "a"}, equal: false},
+		{name: "moved separator", a: []interface{}{"ab", ""}, b: []interface{}{"a", "b"}, equal: false},
+		{name: "extra column", a: []interface{}{"a"}, b: []interface{}{"a", nil}, equal: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if equal := rowHash(tt.a) == rowHash(tt.b); equal != tt.equal {
+				t.Errorf("rowHash(%v) == rowHash(%v) is %v, want %v", tt.a, tt.b, equal, tt.equal)
+			}
+		})
+	}
+}
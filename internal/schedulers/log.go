@@ -0,0 +1,40 @@
+package schedulers
+
+import (
+	"errors"
+	"go-hana/internal/hana"
+	"go.uber.org/zap"
+)
+
+// logger returns the logger of the pipeline, which discards the logs if
+// none is set.
+func (cfg Config) logger() *zap.Logger {
+	if cfg.Logger == nil {
+		return zap.NewNop()
+	}
+	return cfg.Logger
+}
+
+// with returns cfg with fields added to its logger.
+func (cfg Config) with(fields ...zap.Field) Config {
+	cfg.Logger = cfg.logger().With(fields...)
+	return cfg
+}
+
+func documentField(doc map[string]interface{}) zap.Field {
+	return zap.String("document_id", documentKey(doc))
+}
+
+// errorFields describes err with the stage of loading it failed in and the
+// SQL error code of HANA errors.
+func errorFields(err error) []zap.Field {
+	fields := []zap.Field{zap.Error(err)}
+	var se *stageError
+	if errors.As(err, &se) {
+		fields = append(fields, zap.String("stage", se.stage))
+	}
+	if code, ok := hana.ErrorCode(err); ok {
+		fields = append(fields, zap.Int("sql_error_code", code))
+	}
+	return fields
+}
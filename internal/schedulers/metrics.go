@@ -0,0 +1,201 @@
+package schedulers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go-hana/internal/hana"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// reasons of failed documents
+	REASON_TIMEOUT   = "timeout"
+	REASON_TRANSIENT = "transient"
+	REASON_TRANSFORM = stageTransform
+	REASON_RESOLVE   = stageResolve
+	REASON_WRITE     = stageWrite
+)
+
+// discardedMetrics are used by configs without metrics, they are never
+// exported.
+var discardedMetrics = NewMetrics(prometheus.NewRegistry())
+
+// Metrics are the Prometheus metrics of the pipelines. A single instance is
+// shared by the configs of all pipelines.
+type Metrics struct {
+	success map[string]prometheus.Counter
+	failed  map[string]prometheus.Counter
+
+	failures           *prometheus.CounterVec
+	retries            *prometheus.CounterVec
+	timeouts           *prometheus.CounterVec
+	assignedPartitions *prometheus.GaugeVec
+	reconciledRows     *prometheus.GaugeVec
+
+	pageDuration      *prometheus.HistogramVec
+	transformDuration *prometheus.HistogramVec
+	commitDuration    *prometheus.HistogramVec
+
+	lastSuccess   *prometheus.GaugeVec
+	passDocuments *prometheus.GaugeVec
+	lag           *lagCollector
+}
+
+// NewMetrics registers the metrics of the pipelines with reg.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	factory := promauto.With(reg)
+	m := &Metrics{
+		success: make(map[string]prometheus.Counter),
+		failed:  make(map[string]prometheus.Counter),
+
+		failures: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "documents_failed_total",
+			Help: "The total number of documents that failed to load, by the reason of the failure",
+		}, []string{"entity", "reason"}),
+		retries: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "document_retries_total",
+			Help: "The total number of documents retried after a transient HANA error",
+		}, []string{"entity"}),
+		timeouts: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "operation_timeouts_total",
+			Help: "The total number of database operations that ran out of time",
+		}, []string{"entity", "operation"}),
+		assignedPartitions: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "assigned_partitions",
+			Help: "The number of partitions of the current pass assigned to this replica",
+		}, []string{"entity"}),
+		reconciledRows: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "reconciled_rows",
+			Help: "The number of rows found missing, extra or different by the last reconciliation",
+		}, []string{"entity", "kind"}),
+
+		pageDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "page_extraction_duration_seconds",
+			Help:    "The duration of reading a page of documents from MongoDB",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+		}, []string{"entity"}),
+		transformDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "transform_duration_seconds",
+			Help:    "The duration of transforming a document into its HANA representation",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"entity"}),
+		commitDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "hana_commit_duration_seconds",
+			Help:    "The duration of writing a document to HANA, from starting its transaction to committing it",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		}, []string{"entity"}),
+
+		lastSuccess: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "last_successful_run_timestamp_seconds",
+			Help: "The time the last successful pass over the entity finished",
+		}, []string{"entity"}),
+		passDocuments: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "documents_per_pass",
+			Help: "The number of documents read by the last finished pass over the entity",
+		}, []string{"entity"}),
+		lag: &lagCollector{
+			desc: prometheus.NewDesc("replication_lag_seconds",
+				"The age of the newest change synced to HANA, which is when the last completed pass started",
+				[]string{"entity"}, nil),
+			synced: make(map[string]time.Time),
+		},
+	}
+	reg.MustRegister(m.lag)
+
+	// the counters of every entity keep their names of before the labelled
+	// metrics, so existing dashboards go on working
+	for name := range entities {
+		noun := strings.ReplaceAll(name, "_", " ")
+		m.success[name] = factory.NewCounter(prometheus.CounterOpts{
+			Name: fmt.Sprintf("success_processed_%s_total", name),
+			Help: fmt.Sprintf("The total number of successfully processed %s", noun),
+		})
+		m.failed[name] = factory.NewCounter(prometheus.CounterOpts{
+			Name: fmt.Sprintf("failed_processed_%s_total", name),
+			Help: fmt.Sprintf("The total number of failed processed %s", noun),
+		})
+	}
+	return m
+}
+
+// metrics returns the metrics of cfg, or metrics that are never exported if
+// it has none.
+func (cfg Config) metrics() *Metrics {
+	if cfg.Metrics == nil {
+		return discardedMetrics
+	}
+	return cfg.Metrics
+}
+
+func (m *Metrics) loaded(entity string) {
+	m.success[entity].Inc()
+}
+
+func (m *Metrics) failedToLoad(entity string, err error) {
+	m.failed[entity].Inc()
+	m.failures.WithLabelValues(entity, failureReason(err)).Inc()
+}
+
+// passFinished records a finished run. Backfills cover a part of the
+// collection only, so they are not recorded as passes.
+func (m *Metrics) passFinished(run hana.Run) {
+	if run.Mode == hana.RUN_MODE_BACKFILL {
+		return
+	}
+	m.passDocuments.WithLabelValues(run.Entity).Set(float64(run.Read))
+	switch run.Status {
+	case hana.RUN_STATUS_SUCCEEDED:
+		m.lastSuccess.WithLabelValues(run.Entity).Set(float64(run.FinishedAt.Unix()))
+		m.lag.record(run.Entity, run.StartedAt)
+	case hana.RUN_STATUS_PARTIAL:
+		// the failed documents are dead-lettered, all other changes are synced
+		m.lag.record(run.Entity, run.StartedAt)
+	}
+}
+
+// failureReason classifies the error of a failed document.
+func failureReason(err error) string {
+	var se *stageError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return REASON_TIMEOUT
+	case hana.IsTransient(err):
+		return REASON_TRANSIENT
+	case errors.As(err, &se):
+		return se.stage
+	}
+	return REASON_WRITE
+}
+
+// lagCollector exports the replication lag, which grows between the scrapes.
+type lagCollector struct {
+	desc *prometheus.Desc
+
+	mu     sync.Mutex
+	synced map[string]time.Time
+}
+
+func (c *lagCollector) record(entity string, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.After(c.synced[entity]) {
+		c.synced[entity] = t
+	}
+}
+
+func (c *lagCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *lagCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for entity, t := range c.synced {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Since(t).Seconds(), entity)
+	}
+}
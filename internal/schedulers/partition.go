@@ -0,0 +1,348 @@
+package schedulers
+
+import (
+	"context"
+	"fmt"
+	"go-hana/internal/hana"
+	"go-hana/internal/mongodb"
+	"go-hana/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// pollInterval is how often a replica that loaded its partitions checks
+	// whether the others are done with theirs
+	pollInterval = 10 * time.Second
+)
+
+// pass is a single run over all documents of an entity.
+type pass struct {
+	entity
+	cfg     Config
+	mongoDB *mongodb.DB
+	hanaDB  *hana.DB
+	pool    *workerPool
+	number  int64
+	stats   *stats
+
+	// drainCtx is cancelled a grace period after the pass context, so the
+	// documents already handed over to the pool can still be written
+	drainCtx context.Context
+}
+
+// runPass loads the partitions of the current pass over the entity that are
+// assigned to this replica. It returns the run recorded in ETL_RUNS, which is
+// nil if the pass did not start.
+func runPass(ctx context.Context, mongoDB *mongodb.DB, hanaDB *hana.DB, cfg Config, e entity) (run *hana.Run, err error) {
+	ctx, span := cfg.tracer().Start(ctx, "run", trace.WithAttributes(attribute.String("entity", e.name)))
+	defer func() {
+		tracing.End(span, err)
+	}()
+	cfg = cfg.with(tracing.TraceField(ctx))
+
+	rec := newRunRecorder(ctx, hanaDB, cfg, e.name)
+	cfg = cfg.with(zap.String("run_id", rec.run.ID))
+	span.SetAttributes(attribute.String("run_id", rec.run.ID))
+	ps := &pass{
+		entity:  e,
+		cfg:     cfg,
+		mongoDB: mongoDB,
+		hanaDB:  hanaDB,
+		stats:   rec.stats,
+	}
+	if err = ps.cfg.pause(ctx); err != nil {
+		return nil, err
+	}
+	cp, resumed, err := ps.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ps.number = cp.Pass
+	cfg.Control.setPass(cp.Pass)
+
+	mode := hana.RUN_MODE_FULL
+	if resumed {
+		mode = hana.RUN_MODE_RESUME
+	}
+	rec.start(mode, cp.Pass)
+	span.SetAttributes(attribute.String("mode", mode), attribute.Int64("pass", cp.Pass))
+	defer func() {
+		rec.finish(err, ctx.Err() != nil)
+	}()
+
+	drainCtx, cancel := drainContext(ctx, cfg.GracePeriod)
+	defer cancel()
+	ps.drainCtx = drainCtx
+
+	ps.pool = newWorkerPool(cfg.Workers, loader(drainCtx, hanaDB, cfg, e, ps.stats))
+	defer ps.pool.close()
+
+	type result struct {
+		i   int
+		err error
+	}
+	results := make(chan result)
+	running := make(map[int]bool)
+	failed := make(map[int]bool)
+	// stale is set while the checkpoint cannot be read again, claiming from
+	// the old one would load partitions again from where they were before
+	stale := false
+	wait := func() {
+		for range running {
+			<-results
+		}
+	}
+	for {
+		if ctx.Err() != nil {
+			wait()
+			return &rec.run, ctx.Err()
+		}
+
+		// start the partitions assigned to this replica
+		owned := 0
+		for i, p := range cp.Partitions {
+			if !ps.owns(i) {
+				continue
+			}
+			owned++
+			if stale || p.Done || running[i] || failed[i] {
+				continue
+			}
+			i, p := i, p
+			running[i] = true
+			go func() {
+				results <- result{i: i, err: ps.extractPartition(ctx, i, p)}
+			}()
+		}
+		cfg.metrics().assignedPartitions.WithLabelValues(e.name).Set(float64(owned))
+
+		if len(running) == 0 {
+			// a failed partition keeps its checkpoint, the others go on
+			if err != nil || cp.Done() {
+				return &rec.run, err
+			}
+		}
+
+		var changed <-chan struct{}
+		if cfg.Assignment != nil {
+			changed = cfg.Assignment.Changed()
+		}
+		select {
+		case r := <-results:
+			delete(running, r.i)
+			if r.err != nil {
+				failed[r.i] = true
+				if err == nil {
+					err = r.err
+				}
+			}
+		case <-changed:
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			continue
+		}
+
+		// pick up the progress made by this and the other replicas
+		next, gerr := refreshCheckpoint(ctx, cfg, e.name, mongoDB.GetCheckpoint)
+		if gerr != nil {
+			// nothing is claimed until it is read, which is retried after
+			// the next result or poll interval
+			cfg.logger().Error("error while getting checkpoint", zap.Error(gerr))
+			stale = true
+			continue
+		}
+		stale = false
+		if next == nil || next.Pass != ps.number {
+			// another replica finished the pass and started the next one
+			wait()
+			return &rec.run, err
+		}
+		cp = next
+	}
+}
+
+// refreshCheckpoint reads the checkpoint of the entity again with get. A
+// read counts as progress, so a replica that waits for the partitions of the
+// others is not reported as stuck.
+func refreshCheckpoint(ctx context.Context, cfg Config, entity string,
+	get func(ctx context.Context, entity string) (*mongodb.Checkpoint, error)) (*mongodb.Checkpoint, error) {
+	var cp *mongodb.Checkpoint
+	err := withTimeout(ctx, cfg, entity, operationRead, func(ctx context.Context) (err error) {
+		cp, err = get(ctx, entity)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	cfg.Control.progress()
+	return cp, nil
+}
+
+// start returns the checkpoint of the unfinished pass over the entity, or
+// splits the collection into partitions and starts a new pass. It reports
+// whether an unfinished pass is resumed.
+func (ps *pass) start(ctx context.Context) (*mongodb.Checkpoint, bool, error) {
+	for {
+		var cp *mongodb.Checkpoint
+		err := withTimeout(ctx, ps.cfg, ps.name, operationRead, func(ctx context.Context) (err error) {
+			cp, err = ps.mongoDB.GetCheckpoint(ctx, ps.name)
+			return err
+		})
+		if err != nil {
+			return nil, false, fmt.Errorf("getting checkpoint: %v", err)
+		}
+		if cp != nil && !cp.Done() {
+			ps.cfg.logger().Info("resuming scheduler", zap.Int64("pass", cp.Pass))
+			return cp, true, nil
+		}
+
+		var partitions []mongodb.Partition
+		err = withTimeout(ctx, ps.cfg, ps.name, operationRead, func(ctx context.Context) (err error) {
+			partitions, err = ps.mongoDB.GetPartitions(ctx, mongodb.MAIN_DATABASE, ps.collection, ps.cfg.Partitions)
+			return err
+		})
+		if err != nil {
+			return nil, false, fmt.Errorf("splitting into partitions: %v", err)
+		}
+		var prev int64
+		if cp != nil {
+			prev = cp.Pass
+		}
+		next := &mongodb.Checkpoint{Entity: ps.name, Pass: prev + 1, Partitions: partitions}
+		var started bool
+		err = withTimeout(ctx, ps.cfg, ps.name, operationCheckpoint, func(ctx context.Context) (err error) {
+			started, err = ps.mongoDB.StartPass(ctx, next, prev)
+			return err
+		})
+		if err != nil {
+			return nil, false, fmt.Errorf("saving checkpoint: %v", err)
+		}
+		if started {
+			return next, false, nil
+		}
+		// another replica was faster, join its pass
+	}
+}
+
+// owns reports whether the i-th partition is assigned to this replica.
+func (ps *pass) owns(i int) bool {
+	if ps.cfg.Assignment == nil {
+		return true
+	}
+	return ps.cfg.Assignment.Owns(ps.name + "/" + strconv.Itoa(i))
+}
+
+// page is a page of documents submitted to the worker pool. Once all of them
+// are handled, the partition can be checkpointed at the page's last _id.
+type page struct {
+	wg        sync.WaitGroup
+	partition mongodb.Partition
+	// span is ended once the page is checkpointed
+	span trace.Span
+	// interrupted is set if a document of the page was not written because
+	// of a shutdown
+	interrupted int32
+}
+
+func (pg *page) done(err error) {
+	if err != nil {
+		atomic.StoreInt32(&pg.interrupted, 1)
+	}
+	pg.wg.Done()
+}
+
+// extractPartition reads the i-th partition of the entity page by page. Each
+// page is checkpointed once its documents are handled, while the next page
+// is already being loaded. When ctx is cancelled or the partition is
+// assigned to another replica, the extraction stops and the page in flight
+// is checkpointed once it is drained.
+func (ps *pass) extractPartition(ctx context.Context, i int, p mongodb.Partition) error {
+	var pending *page
+	flush := func() error {
+		if pending == nil {
+			return nil
+		}
+		pg := pending
+		pending = nil
+		return ps.checkpoint(i, pg)
+	}
+
+	for !p.Done {
+		if !ps.owns(i) {
+			ps.cfg.logger().Info("partition moved to another replica", zap.Int("partition", i))
+			return flush()
+		}
+
+		if err := ps.cfg.pause(ctx); err != nil {
+			if ferr := flush(); ferr != nil {
+				ps.cfg.logger().Error("error while checkpointing", zap.Int("partition", i), zap.Error(ferr))
+			}
+			return err
+		}
+
+		pageCtx, span := ps.cfg.tracer().Start(ctx, "page", trace.WithAttributes(attribute.Int("partition", i)))
+		var docs []map[string]interface{}
+		started := time.Now()
+		err := withTimeout(pageCtx, ps.cfg, ps.name, operationRead, func(ctx context.Context) (err error) {
+			docs, err = ps.mongoDB.GetRange(ctx, mongodb.MAIN_DATABASE, ps.collection, p, int64(ps.cfg.pageSize()))
+			return err
+		})
+		ps.cfg.metrics().pageDuration.WithLabelValues(ps.name).Observe(time.Since(started).Seconds())
+		if err != nil {
+			tracing.End(span, err)
+			if ferr := flush(); ferr != nil {
+				ps.cfg.logger().Error("error while checkpointing", zap.Int("partition", i), zap.Error(ferr))
+			}
+			return fmt.Errorf("getting %s from MongoDB: %v", ps.name, err)
+		}
+
+		ps.stats.addRead(len(docs))
+		span.SetAttributes(attribute.Int("documents", len(docs)))
+		pg := &page{span: span}
+		pg.wg.Add(len(docs))
+		for _, doc := range docs {
+			if err = ps.pool.submit(pageCtx, doc, pg.done); err != nil {
+				tracing.End(span, err)
+				if ferr := flush(); ferr != nil {
+					ps.cfg.logger().Error("error while checkpointing", zap.Int("partition", i), zap.Error(ferr))
+				}
+				return err
+			}
+		}
+		if len(docs) > 0 {
+			p.Last = docs[len(docs)-1]["_id"]
+		}
+		p.Done = len(docs) < ps.cfg.pageSize()
+		pg.partition = p
+
+		if err = flush(); err != nil {
+			return err
+		}
+		pending = pg
+	}
+	return flush()
+}
+
+// checkpoint waits until the documents of pg are handled and saves the
+// progress of the i-th partition, unless the page was interrupted.
+func (ps *pass) checkpoint(i int, pg *page) (err error) {
+	defer func() {
+		tracing.End(pg.span, err)
+	}()
+	pg.wg.Wait()
+	if atomic.LoadInt32(&pg.interrupted) != 0 {
+		return nil
+	}
+	if err := withTimeout(ps.drainCtx, ps.cfg, ps.name, operationCheckpoint, func(ctx context.Context) error {
+		return ps.mongoDB.SavePartition(ctx, ps.name, ps.number, i, pg.partition)
+	}); err != nil {
+		return fmt.Errorf("saving checkpoint of partition %d: %v", i, err)
+	}
+	return nil
+}
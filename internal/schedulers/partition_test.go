@@ -0,0 +1,59 @@
+package schedulers
+
+import (
+	"context"
+	"errors"
+	"go-hana/internal/mongodb"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func TestRefreshCheckpointRecordsProgress(t *testing.T) {
+	control := NewControls(zap.NewNop())[SHOPS]
+	cfg := Config{Control: control}
+	want := &mongodb.Checkpoint{Pass: 3}
+
+	// a replica waiting for the partitions of the others only reads the
+	// checkpoint, which must keep it from being reported as stuck
+	before := time.Now()
+	got, err := refreshCheckpoint(context.Background(), cfg, SHOPS, func(ctx context.Context, entity string) (*mongodb.Checkpoint, error) {
+		if entity != SHOPS {
+			t.Errorf("entity = %q, want %q", entity, SHOPS)
+		}
+		return want, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("refreshCheckpoint() = %v, want %v", got, want)
+	}
+	if at := control.State().ProgressAt; at.Before(before) {
+		t.Errorf("ProgressAt = %v, want after %v", at, before)
+	}
+}
+
+func TestRefreshCheckpointFailed(t *testing.T) {
+	control := NewControls(zap.NewNop())[SHOPS]
+	cfg := Config{Control: control}
+	failure := errors.New("server selection timeout")
+
+	_, err := refreshCheckpoint(context.Background(), cfg, SHOPS, func(ctx context.Context, entity string) (*mongodb.Checkpoint, error) {
+		return nil, failure
+	})
+	if !errors.Is(err, failure) {
+		t.Errorf("refreshCheckpoint() = %v, want %v", err, failure)
+	}
+	if at := control.State().ProgressAt; !at.IsZero() {
+		t.Errorf("ProgressAt = %v after a failed read, want none", at)
+	}
+}
+
+func TestRefreshCheckpointWithoutControl(t *testing.T) {
+	if _, err := refreshCheckpoint(context.Background(), Config{}, SHOPS, func(ctx context.Context, entity string) (*mongodb.Checkpoint, error) {
+		return nil, nil
+	}); err != nil {
+		t.Errorf("refreshCheckpoint() = %v", err)
+	}
+}
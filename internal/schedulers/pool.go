@@ -0,0 +1,82 @@
+package schedulers
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
+	"hash/fnv"
+	"sync"
+)
+
+const (
+	// queueSize is the number of documents buffered per worker
+	queueSize = 100
+)
+
+// workerPool writes the documents of one entity concurrently. Every document
+// is routed to a worker by its primary key, so two versions of the same
+// document are always handled by the same worker, in the order they were
+// submitted, and never race each other.
+type workerPool struct {
+	queues []chan job
+	wg     sync.WaitGroup
+}
+
+type job struct {
+	doc map[string]interface{}
+	// parent is the span the document was submitted in
+	parent trace.SpanContext
+	done   func(err error)
+}
+
+func newWorkerPool(workers int, handle func(parent trace.SpanContext, doc map[string]interface{}) error) *workerPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	p := &workerPool{queues: make([]chan job, workers)}
+	for i := range p.queues {
+		queue := make(chan job, queueSize)
+		p.queues[i] = queue
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for j := range queue {
+				j.done(handle(j.parent, j.doc))
+			}
+		}()
+	}
+	return p
+}
+
+// submit hands doc to the worker owning its primary key and calls done with
+// the result of handling it. It blocks while that worker's queue is full,
+// which throttles extraction to the write speed.
+func (p *workerPool) submit(ctx context.Context, doc map[string]interface{}, done func(err error)) error {
+	queue := p.queues[keyHash(documentKey(doc))%uint32(len(p.queues))]
+	select {
+	case queue <- job{doc: doc, parent: trace.SpanContextFromContext(ctx), done: done}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close stops accepting documents and waits until the queued ones are written.
+func (p *workerPool) close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
+
+func documentKey(doc map[string]interface{}) string {
+	return fmt.Sprint(doc["_id"])
+}
+
+func keyHash(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32()
+}
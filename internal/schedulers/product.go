@@ -3,318 +3,360 @@ package schedulers
 import (
 	"context"
 	"database/sql"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"errors"
+	"fmt"
 	"go-hana/internal/hana"
 	"go-hana/internal/mongodb"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"log"
+	"go.uber.org/zap"
 	"strconv"
 )
 
-var (
-	successProcessedProductsTotal = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "success_processed_products_total",
-		Help: "The total number of successfully processed products",
-	})
+var productEntity = entity{
+	name:       PRODUCTS,
+	collection: mongodb.PRODUCTS_COLLECTION,
+	table:      "PRODUCTS",
+	// BRAND_ID is left out, it is only known once the brand is resolved
+	columns: []string{"ADJUSTED_RATING", "CATEGORY_ID", "CREATED_TIME", "CREDIT_MONTHLY_PRICE", "CURRENCY",
+		"DELIVERY_DURATION", "DISCOUNT", "HAS_VARIANTS", "LOAN_AVAILABLE", "RATING", "REVIEWS_LINK",
+		"REVIEWS_QUANTITY", "LINK", "TITLE", "UNIT_PRICE", "UNIT_SALE_PRICE", "WEIGHT"},
+	transform: transformProduct,
+}
 
-	failedProcessedProductsTotal = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "failed_processed_products_total",
-		Help: "The total number of failed processed products",
-	})
-)
+func NewProductScheduler(ctx context.Context, mongoDB *mongodb.DB, hanaDB *hana.DB, cfg Config) error {
+	return run(ctx, mongoDB, hanaDB, cfg, productEntity)
+}
 
-func NewProductScheduler(ctx context.Context, mongoDB *mongodb.DB, hanaDB *hana.DB) error {
-	log.Printf("starting product scheduler")
+type product struct {
+	id                 interface{}
+	adjustedRating     interface{}
+	brand              string
+	categoryId         int64
+	createdTime        interface{}
+	creditMonthlyPrice interface{}
+	currency           interface{}
+	deliveryDuration   interface{}
+	discount           interface{}
+	hasVariants        interface{}
+	loanAvailable      interface{}
+	rating             interface{}
+	reviewsLink        interface{}
+	reviewsQuantity    interface{}
+	link               interface{}
+	title              interface{}
+	unitPrice          interface{}
+	unitSalePrice      interface{}
+	weight             interface{}
+
+	categories         []string
+	categoryCodes      []string
+	monthlyInstallment *productInstallment
+	promos             []productPromo
+
+	// resolved dimension ids
+	brandId         int64
+	categoryIds     []int64
+	categoryCodeIds []int64
+}
 
-	// 1. Get all products count from MongoDB
-	// 1. Get all products by 1000 (with skip and limit)
-	// 2. Insert into HANA
-	// 3. Repeat until all products are inserted
-	// 4. When all products are inserted, restart the scheduler
-	var errChannel = make(chan error)
-	var doneChannel = make(chan bool)
+type productInstallment struct {
+	id          int64
+	installment bool
+	perMonth    string
+}
 
-	go func() {
-		count, err := mongoDB.GetCount(ctx, mongodb.MAIN_DATABASE, mongodb.PRODUCTS_COLLECTION)
-		if err != nil {
-			errChannel <- err
-			return
+type productPromo struct {
+	code      string
+	text      *string
+	promoType string
+	priority  int64
+}
+
+func transformProduct(lg *zap.Logger, doc map[string]interface{}) (record, error) {
+	// get product fields
+	p := &product{
+		id:                 doc["_id"],
+		adjustedRating:     doc["adjustedRating"],
+		createdTime:        doc["createdTime"],
+		creditMonthlyPrice: doc["creditMonthlyPrice"],
+		currency:           doc["currency"],
+		deliveryDuration:   doc["deliveryDuration"],
+		discount:           doc["discount"],
+		hasVariants:        doc["hasVariants"],
+		loanAvailable:      doc["loanAvailable"],
+		rating:             doc["rating"],
+		reviewsLink:        doc["reviewsLink"],
+		reviewsQuantity:    doc["reviewsQuantity"],
+		link:               doc["shopLink"],
+		title:              doc["title"],
+		unitPrice:          doc["unitPrice"],
+		unitSalePrice:      doc["unitSalePrice"],
+		weight:             doc["weight"],
+	}
+
+	categId, ok := doc["categoryId"].(string)
+	if !ok {
+		return nil, errors.New("converting categoryId to string")
+	}
+	categoryId, err := strconv.ParseInt(categId, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("converting categoryId to int: %w", err)
+	}
+	p.categoryId = categoryId
+
+	if p.brand, ok = doc["brand"].(string); !ok {
+		return nil, errors.New("converting brand to string")
+	}
+
+	cats, ok := doc["category"].(primitive.A)
+	if !ok {
+		return nil, errors.New("converting category to array")
+	}
+	for _, c := range cats {
+		categoryName, ok := c.(string)
+		if !ok {
+			lg.Warn("skipping category that is not a string", zap.Any("category", c))
+			continue
+		}
+		p.categories = append(p.categories, categoryName)
+	}
+
+	catCodes, ok := doc["categoryCodes"].(primitive.A)
+	if !ok {
+		return nil, errors.New("converting categoryCodes to array")
+	}
+	for _, catCode := range catCodes {
+		categoryCode, ok := catCode.(string)
+		if !ok {
+			lg.Warn("skipping category code that is not a string", zap.Any("category_code", catCode))
+			continue
+		}
+		p.categoryCodes = append(p.categoryCodes, categoryCode)
+	}
+
+	if monthlyInstallment := doc["monthlyInstallment"]; monthlyInstallment != nil {
+		monthlyInstallmentMap, ok := monthlyInstallment.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("converting monthlyInstallment to map")
 		}
 
-		for i := int64(0); i < count; i += 1000 {
-			products, err := mongoDB.GetAll(ctx, mongodb.MAIN_DATABASE, mongodb.PRODUCTS_COLLECTION, i, 1000)
-			if err != nil {
-				log.Printf("error getting products: %v\n", err)
-				failedProcessedProductsTotal.Add(1000)
+		installmentId, ok := monthlyInstallmentMap["id"].(float64)
+		if !ok {
+			return nil, errors.New("converting monthlyInstallment id to float")
+		}
+		installment, ok := monthlyInstallmentMap["installment"].(bool)
+		if !ok {
+			return nil, errors.New("converting monthlyInstallment installment to bool")
+		}
+		formattedPerMonth, ok := monthlyInstallmentMap["formattedPerMonth"].(string)
+		if !ok {
+			return nil, errors.New("converting monthlyInstallment formattedPerMonth to string")
+		}
+		p.monthlyInstallment = &productInstallment{
+			id:          int64(installmentId),
+			installment: installment,
+			perMonth:    formattedPerMonth,
+		}
+	}
+
+	if promo := doc["promo"]; promo != nil {
+		promos, ok := promo.(primitive.A)
+		if !ok {
+			return nil, errors.New("converting promo to array")
+		}
+
+		for _, pr := range promos {
+			promoMap, ok := pr.(map[string]interface{})
+			if !ok {
+				lg.Warn("skipping promo that is not a map", zap.Any("promo", pr))
 				continue
 			}
 
-			for _, product := range products {
-				// start transaction
-				tx, err := hanaDB.Begin()
-				if err != nil {
-					log.Printf("error while starting transaction: %v\n", err)
-					failedProcessedProductsTotal.Add(1)
-					continue
-				}
-
-				// get product fields
-				id := product["_id"]
-				adjustedRating := product["adjustedRating"]
-				brand := product["brand"]
-				category := product["category"]
-				categoryCodes := product["categoryCodes"]
-				catId := product["categoryId"]
-				createdTime := product["createdTime"]
-				creditMonthlyPrice := product["creditMonthlyPrice"]
-				currency := product["currency"]
-				deliveryDuration := product["deliveryDuration"]
-				discount := product["discount"]
-				hasVariants := product["hasVariants"]
-				loanAvailable := product["loanAvailable"]
-				monthlyInstallment := product["monthlyInstallment"]
-				promo := product["promo"]
-				rating := product["rating"]
-				reviewsLink := product["reviewsLink"]
-				reviewsQuantity := product["reviewsQuantity"]
-				link := product["shopLink"]
-				title := product["title"]
-				unitPrice := product["unitPrice"]
-				unitSalePrice := product["unitSalePrice"]
-				weight := product["weight"]
-
-				categId, ok := catId.(string)
+			priority, ok := promoMap["priority"].(float64)
+			if !ok {
+				lg.Warn("skipping promo whose priority is not a number", zap.Any("priority", promoMap["priority"]))
+				continue
+			}
+			code, ok := promoMap["code"].(string)
+			if !ok {
+				lg.Warn("skipping promo whose code is not a string", zap.Any("code", promoMap["code"]))
+				continue
+			}
+			var text *string
+			if promoMap["text"] != nil {
+				t, ok := promoMap["text"].(string)
 				if !ok {
-					log.Printf("error while converting categoryId to string: %v\n", err)
-					failedProcessedProductsTotal.Add(1)
-					continue
-				}
-				categoryId, err := strconv.ParseInt(categId, 10, 64)
-				if err != nil {
-					log.Printf("error while converting categoryId to int: %v\n", err)
-					failedProcessedProductsTotal.Add(1)
+					lg.Warn("skipping promo whose text is not a string", zap.Any("text", promoMap["text"]))
 					continue
 				}
+				text = &t
+			}
+			promoType, ok := promoMap["type"].(string)
+			if !ok {
+				lg.Warn("skipping promo whose type is not a string", zap.Any("type", promoMap["type"]))
+				continue
+			}
 
-				// find brand id in HANA, if not found, insert into HANA
-				var brandId int64
-				if err = tx.QueryRow("SELECT ID FROM BRANDS WHERE NAME = ?", brand).Scan(&brandId); err != nil {
-					if err != sql.ErrNoRows {
-						log.Printf("error while getting brand id: %v\n", err)
-						failedProcessedProductsTotal.Add(1)
-						continue
-					}
-
-					if _, err = tx.Exec("INSERT INTO BRANDS (NAME) VALUES (?)", brand); err != nil {
-						log.Printf("error while inserting brand: %v\n", err)
-						failedProcessedProductsTotal.Add(1)
-						continue
-					}
-					if err = tx.QueryRow("SELECT ID FROM BRANDS WHERE NAME = ?", brand).Scan(&brandId); err != nil {
-						log.Printf("error while getting brand id: %v\n", err)
-						failedProcessedProductsTotal.Add(1)
-						continue
-					}
-				}
+			p.promos = append(p.promos, productPromo{
+				code:      code,
+				text:      text,
+				promoType: promoType,
+				priority:  int64(priority),
+			})
+		}
+	}
 
-				// find categories id in HANA, if not found, insert into HANA
-				categories, ok := category.(primitive.A)
-				if !ok {
-					log.Printf("error while converting category to array: %v\n", err)
-					failedProcessedProductsTotal.Add(1)
-					continue
-				}
-				for _, c := range categories {
-					categoryName, ok := c.(string)
-					if !ok {
-						log.Printf("error while converting category to string: %v\n", err)
-						continue
-					}
-
-					var cId int64
-					if err = tx.QueryRow("SELECT ID FROM CATEGORIES WHERE NAME = ?", categoryName).Scan(&cId); err != nil {
-						if err != sql.ErrNoRows {
-							log.Printf("error while getting category id: %v\n", err)
-							continue
-						}
-
-						if _, err = tx.Exec("INSERT INTO CATEGORIES (NAME) VALUES (?)", categoryName); err != nil {
-							log.Printf("error while inserting category: %v\n", err)
-							continue
-						}
-						if err = tx.QueryRow("SELECT ID FROM CATEGORIES WHERE NAME = ?", categoryName).Scan(&cId); err != nil {
-							log.Printf("error while getting category id: %v\n", err)
-							continue
-						}
-					}
-
-					if _, err = tx.Exec("INSERT INTO PRODUCT_CATEGORIES (PRODUCT_ID, CATEGORY_ID) VALUES (?, ?)", id, cId); err != nil {
-						//@TODO: don't log
-						//errChannel <- err
-						//return
-					}
-				}
+	return p, nil
+}
 
-				// find category codes id in HANA, if not found, insert into HANA
-				catCodes, ok := categoryCodes.(primitive.A)
-				if !ok {
-					log.Printf("error while converting categoryCodes to array: %v\n", err)
-					failedProcessedProductsTotal.Add(1)
-					continue
-				}
-				for _, catCode := range catCodes {
-					categoryCode, ok := catCode.(string)
-					if !ok {
-						log.Printf("error while converting categoryCodes to string: %v\n", err)
-						continue
-					}
-
-					var categoryCodeId int64
-					if err = tx.QueryRow("SELECT ID FROM CATEGORY_CODES WHERE CODE = ?", categoryCode).Scan(&categoryCodeId); err != nil {
-						if err != sql.ErrNoRows {
-							log.Printf("error while getting category code id: %v\n", err)
-							continue
-						}
-
-						if _, err = tx.Exec("INSERT INTO CATEGORY_CODES (CODE) VALUES (?)", categoryCode); err != nil {
-							log.Printf("error while inserting category code: %v\n", err)
-							continue
-						}
-						if err = tx.QueryRow("SELECT ID FROM CATEGORY_CODES WHERE CODE = ?", categoryCode).Scan(&categoryCodeId); err != nil {
-							log.Printf("error while getting category code id: %v\n", err)
-							continue
-						}
-					}
-
-					if _, err = tx.Exec("INSERT INTO PRODUCT_CATEGORY_CODES (PRODUCT_ID, CATEGORY_CODE_ID) VALUES (?, ?)", id, categoryCodeId); err != nil {
-						//@TODO: don't log
-						//errChannel <- err
-						//return
-					}
-				}
+func (p *product) resolve(ctx context.Context, lg *zap.Logger, hanaDB *hana.DB) error {
+	// find brand id in HANA, if not found, insert into HANA
+	brandId, err := brands.id(ctx, hanaDB, p.brand)
+	if err != nil {
+		return fmt.Errorf("getting brand id: %w", err)
+	}
+	p.brandId = brandId
+
+	// find categories id in HANA, if not found, insert into HANA. A failed
+	// lookup fails the document, the child rows would be replaced by a
+	// partial set otherwise
+	p.categoryIds = p.categoryIds[:0]
+	for _, categoryName := range p.categories {
+		cId, err := categories.id(ctx, hanaDB, categoryName)
+		if err != nil {
+			return fmt.Errorf("getting id of category %s: %w", categoryName, err)
+		}
+		p.categoryIds = append(p.categoryIds, cId)
+	}
 
-				// insert into products
-				_, err = tx.Exec("INSERT INTO PRODUCTS (ID, ADJUSTED_RATING, BRAND_ID, CATEGORY_ID, CREATED_TIME, "+
-					"CREDIT_MONTHLY_PRICE, CURRENCY, DELIVERY_DURATION, DISCOUNT, HAS_VARIANTS, LOAN_AVAILABLE, RATING, "+
-					"REVIEWS_LINK, REVIEWS_QUANTITY, LINK, TITLE, UNIT_PRICE, UNIT_SALE_PRICE, WEIGHT) VALUES "+
-					"(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-					id, adjustedRating, brandId, categoryId, createdTime, creditMonthlyPrice, currency, deliveryDuration,
-					discount, hasVariants, loanAvailable, rating, reviewsLink, reviewsQuantity, link, title, unitPrice,
-					unitSalePrice, weight)
-				if err != nil {
-					//errChannel <- err
-					//return
-				}
+	// find category codes id in HANA, if not found, insert into HANA
+	p.categoryCodeIds = p.categoryCodeIds[:0]
+	for _, categoryCode := range p.categoryCodes {
+		categoryCodeId, err := categoryCodes.id(ctx, hanaDB, categoryCode)
+		if err != nil {
+			return fmt.Errorf("getting id of category code %s: %w", categoryCode, err)
+		}
+		p.categoryCodeIds = append(p.categoryCodeIds, categoryCodeId)
+	}
+	return nil
+}
 
-				// insert into product monthly installments
-				if monthlyInstallment != nil {
-					monthlyInstallmentMap, ok := monthlyInstallment.(map[string]interface{})
-					if !ok {
-						log.Printf("error while converting monthlyInstallment to map: %v\n", err)
-						failedProcessedProductsTotal.Add(1)
-						continue
-					}
-
-					installmentId, ok := monthlyInstallmentMap["id"].(float64)
-					if !ok {
-						log.Printf("error while converting monthlyInstallment id to float: %v\n", err)
-						failedProcessedProductsTotal.Add(1)
-						continue
-					}
-					installment, ok := monthlyInstallmentMap["installment"].(bool)
-					if !ok {
-						log.Printf("error while converting monthlyInstallment installment to bool: %v\n", err)
-						failedProcessedProductsTotal.Add(1)
-						continue
-					}
-					formattedPerMonth, ok := monthlyInstallmentMap["formattedPerMonth"].(string)
-					if !ok {
-						log.Printf("error while converting monthlyInstallment formattedPerMonth to string: %v\n", err)
-						failedProcessedProductsTotal.Add(1)
-						continue
-					}
-
-					if _, err = tx.Exec("INSERT INTO PRODUCT_MONTHLY_INSTALLMENTS (PRODUCT_ID, "+
-						"INSTALLMENT_ID, INSTALLMENT, INSTALLMENT_PER_MONTH) VALUES (?, ?, ?, ?)", id,
-						int64(installmentId), installment, formattedPerMonth); err != nil {
-						log.Printf("error while inserting product monthly installment: %v\n", err)
-						failedProcessedProductsTotal.Add(1)
-						continue
-					}
-				}
+func (p *product) values() []interface{} {
+	return []interface{}{p.adjustedRating, p.categoryId, p.createdTime, p.creditMonthlyPrice, p.currency,
+		p.deliveryDuration, p.discount, p.hasVariants, p.loanAvailable, p.rating, p.reviewsLink, p.reviewsQuantity,
+		p.link, p.title, p.unitPrice, p.unitSalePrice, p.weight}
+}
 
-				// insert into product promo
-				if promo != nil {
-					promos, ok := promo.(primitive.A)
-					if !ok {
-						log.Printf("error while converting promo to array: %v\n", err)
-						failedProcessedProductsTotal.Add(1)
-						continue
-					}
-
-					for _, p := range promos {
-						promoMap, ok := p.(map[string]interface{})
-						if !ok {
-							log.Printf("error while converting promo to map: %v\n", err)
-							continue
-						}
-
-						priority, ok := promoMap["priority"].(float64)
-						if !ok {
-							log.Printf("error while converting promo priority to float: %v\n", err)
-							continue
-						}
-						code, ok := promoMap["code"].(string)
-						if !ok {
-							log.Printf("error while converting promo code to string: %v\n", err)
-							continue
-						}
-						var text *string
-						if promoMap["text"] != nil {
-							t, ok := promoMap["text"].(string)
-							if !ok {
-								log.Printf("error while converting promo text to string: %v\n", err)
-								continue
-							}
-							text = &t
-						}
-						promoType, ok := promoMap["type"].(string)
-						if !ok {
-							log.Printf("error while converting promo type to string: %v\n", err)
-							continue
-						}
-
-						if _, err = tx.Exec("INSERT INTO PRODUCT_PROMOS (PRODUCT_ID, CODE, COMMENT, TYPE, PRIORITY) "+
-							"VALUES (?, ?, ?, ?, ?)", id, code, text, promoType, int64(priority)); err != nil {
-							log.Printf("error inserting product promo: %v\n", err)
-							continue
-						}
-					}
-				}
+// hash hashes the mapped values of the product and of its child rows.
+func (p *product) hash() int64 {
+	values := append(p.values(), p.brandId)
+	for _, cId := range distinct(p.categoryIds) {
+		values = append(values, "category", cId)
+	}
+	for _, categoryCodeId := range distinct(p.categoryCodeIds) {
+		values = append(values, "category code", categoryCodeId)
+	}
+	if i := p.monthlyInstallment; i != nil {
+		values = append(values, "installment", i.id, i.installment, i.perMonth)
+	}
+	for _, promo := range p.promos {
+		values = append(values, "promo", promo.code, promo.text, promo.promoType, promo.priority)
+	}
+	return int64(rowHash(values))
+}
 
-				// commit transaction
-				if err = tx.Commit(); err != nil {
-					log.Printf("error commiting transaction: %v\n", err)
-					failedProcessedProductsTotal.Add(1)
-					continue
-				}
+func (p *product) write(ctx context.Context, tx *sql.Tx) (outcome, error) {
+	// find by id, if not exists then insert, if changed then update, else skip
+	hash := p.hash()
+	o := updated
+	var stored sql.NullInt64
+	if err := tx.QueryRowContext(ctx, "SELECT ROW_HASH FROM PRODUCTS WHERE ID = ?", p.id).Scan(&stored); err != nil {
+		if err != sql.ErrNoRows {
+			return 0, fmt.Errorf("scanning product hash: %w", err)
+		}
 
-				successProcessedProductsTotal.Add(1)
-			}
+		// insert
+		_, err = tx.ExecContext(ctx, "INSERT INTO PRODUCTS (ID, ADJUSTED_RATING, BRAND_ID, CATEGORY_ID, CREATED_TIME, "+
+			"CREDIT_MONTHLY_PRICE, CURRENCY, DELIVERY_DURATION, DISCOUNT, HAS_VARIANTS, LOAN_AVAILABLE, RATING, "+
+			"REVIEWS_LINK, REVIEWS_QUANTITY, LINK, TITLE, UNIT_PRICE, UNIT_SALE_PRICE, WEIGHT, ROW_HASH) VALUES "+
+			"(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			p.id, p.adjustedRating, p.brandId, p.categoryId, p.createdTime, p.creditMonthlyPrice, p.currency,
+			p.deliveryDuration, p.discount, p.hasVariants, p.loanAvailable, p.rating, p.reviewsLink, p.reviewsQuantity,
+			p.link, p.title, p.unitPrice, p.unitSalePrice, p.weight, hash)
+		if err != nil {
+			return 0, fmt.Errorf("inserting product: %w", err)
+		}
+		o = inserted
+	} else if stored.Valid && stored.Int64 == hash {
+		// the child rows are part of the hash, so they are unchanged as well
+		return skipped, nil
+	} else {
+		// update
+		_, err = tx.ExecContext(ctx, "UPDATE PRODUCTS SET ADJUSTED_RATING = ?, BRAND_ID = ?, CATEGORY_ID = ?, CREATED_TIME = ?, "+
+			"CREDIT_MONTHLY_PRICE = ?, CURRENCY = ?, DELIVERY_DURATION = ?, DISCOUNT = ?, HAS_VARIANTS = ?, "+
+			"LOAN_AVAILABLE = ?, RATING = ?, REVIEWS_LINK = ?, REVIEWS_QUANTITY = ?, LINK = ?, TITLE = ?, "+
+			"UNIT_PRICE = ?, UNIT_SALE_PRICE = ?, WEIGHT = ?, ROW_HASH = ? WHERE ID = ?",
+			p.adjustedRating, p.brandId, p.categoryId, p.createdTime, p.creditMonthlyPrice, p.currency,
+			p.deliveryDuration, p.discount, p.hasVariants, p.loanAvailable, p.rating, p.reviewsLink, p.reviewsQuantity,
+			p.link, p.title, p.unitPrice, p.unitSalePrice, p.weight, hash, p.id)
+		if err != nil {
+			return 0, fmt.Errorf("updating product: %w", err)
+		}
+	}
+
+	// replace the child rows, so they mirror the current document
+	for _, table := range []string{"PRODUCT_CATEGORIES", "PRODUCT_CATEGORY_CODES", "PRODUCT_MONTHLY_INSTALLMENTS",
+		"PRODUCT_PROMOS"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE PRODUCT_ID = ?", p.id); err != nil {
+			return 0, fmt.Errorf("deleting from %s: %w", table, err)
+		}
+	}
+
+	// insert into product categories
+	for _, cId := range distinct(p.categoryIds) {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO PRODUCT_CATEGORIES (PRODUCT_ID, CATEGORY_ID) VALUES (?, ?)",
+			p.id, cId); err != nil {
+			return 0, fmt.Errorf("inserting product category: %w", err)
 		}
+	}
+
+	// insert into product category codes
+	for _, categoryCodeId := range distinct(p.categoryCodeIds) {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO PRODUCT_CATEGORY_CODES (PRODUCT_ID, CATEGORY_CODE_ID) VALUES (?, ?)",
+			p.id, categoryCodeId); err != nil {
+			return 0, fmt.Errorf("inserting product category code: %w", err)
+		}
+	}
+
+	// insert into product monthly installments
+	if i := p.monthlyInstallment; i != nil {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO PRODUCT_MONTHLY_INSTALLMENTS (PRODUCT_ID, "+
+			"INSTALLMENT_ID, INSTALLMENT, INSTALLMENT_PER_MONTH) VALUES (?, ?, ?, ?)", p.id,
+			i.id, i.installment, i.perMonth); err != nil {
+			return 0, fmt.Errorf("inserting product monthly installment: %w", err)
+		}
+	}
+
+	// insert into product promos, keyed by their position in the document
+	for position, promo := range p.promos {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO PRODUCT_PROMOS (PRODUCT_ID, POSITION, CODE, COMMENT, TYPE, PRIORITY) "+
+			"VALUES (?, ?, ?, ?, ?, ?)", p.id, position, promo.code, promo.text, promo.promoType,
+			promo.priority); err != nil {
+			return 0, fmt.Errorf("inserting product promo: %w", err)
+		}
+	}
+	return o, nil
+}
 
-		doneChannel <- true
-	}()
-
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case err := <-errChannel:
-		log.Printf("error in product scheduler: %v\n", err)
-		return NewProductScheduler(ctx, mongoDB, hanaDB)
-	case <-doneChannel:
-		log.Printf("product scheduler is done")
-		return NewProductScheduler(ctx, mongoDB, hanaDB)
+// distinct returns ids without duplicates, in their original order.
+func distinct(ids []int64) []int64 {
+	seen := make(map[int64]bool, len(ids))
+	result := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
 	}
+	return result
 }
@@ -0,0 +1,277 @@
+package schedulers
+
+import (
+	"context"
+	"fmt"
+	"go-hana/internal/hana"
+	"go-hana/internal/mongodb"
+	"go.uber.org/zap"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxReportedIDs is the number of IDs of each kind listed in a report,
+	// all of them are enqueued for re-sync though
+	maxReportedIDs = 1000
+
+	// reasons of re-syncing a document
+	RESYNC_MISSING   = "missing"
+	RESYNC_DIFFERENT = "different"
+)
+
+// ReconcileConfig holds the settings of the reconciliation.
+type ReconcileConfig struct {
+	// Interval is how often the scheduled reconciliation runs.
+	Interval time.Duration
+	// Buckets is the number of _id ranges whose checksums are compared.
+	Buckets int
+	// Enqueue queues the missing and different documents for re-sync, they
+	// are loaded before the next pass of their entity.
+	Enqueue bool
+}
+
+// ReconcileReport is the result of comparing an entity in MongoDB and HANA.
+type ReconcileReport struct {
+	Entity     string `json:"entity"`
+	MongoCount int64  `json:"mongoCount"`
+	HanaCount  int64  `json:"hanaCount"`
+	// Invalid is the number of documents that cannot be transformed, they
+	// are not compared
+	Invalid int64 `json:"invalid"`
+	// Buckets are the _id ranges whose checksums differ.
+	Buckets   []BucketReport `json:"buckets"`
+	Missing   []string       `json:"missing"`
+	Extra     []string       `json:"extra"`
+	Different []string       `json:"different"`
+	// the number of IDs of each kind, which may be more than listed
+	MissingCount   int `json:"missingCount"`
+	ExtraCount     int `json:"extraCount"`
+	DifferentCount int `json:"differentCount"`
+	Enqueued       int `json:"enqueued"`
+}
+
+// BucketReport compares a single _id range.
+type BucketReport struct {
+	Lower         string `json:"lower,omitempty"`
+	Upper         string `json:"upper,omitempty"`
+	MongoRows     int    `json:"mongoRows"`
+	HanaRows      int    `json:"hanaRows"`
+	MongoChecksum string `json:"mongoChecksum"`
+	HanaChecksum  string `json:"hanaChecksum"`
+}
+
+// NewReconcileScheduler reconciles all entities every interval until ctx is
+// cancelled. With an assignment, every entity is reconciled by the replica
+// that owns it.
+func NewReconcileScheduler(ctx context.Context, mongoDB *mongodb.DB, hanaDB *hana.DB, cfg Config, rc ReconcileConfig) error {
+	for {
+		for _, name := range EntityNames() {
+			if cfg.Assignment != nil && !cfg.Assignment.Owns("reconcile/"+name) {
+				continue
+			}
+			report, err := Reconcile(ctx, mongoDB, hanaDB, cfg, rc, name)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return fmt.Errorf("error in reconcile scheduler: %v", err)
+			}
+			cfg.logger().Info("reconciled entity", zap.String("entity", name),
+				zap.Int64("documents", report.MongoCount), zap.Int64("rows", report.HanaCount),
+				zap.Int("missing", report.MissingCount), zap.Int("extra", report.ExtraCount),
+				zap.Int("different", report.DifferentCount), zap.Int("enqueued", report.Enqueued))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(rc.Interval):
+		}
+	}
+}
+
+// Reconcile compares the documents of an entity in MongoDB with its rows in
+// HANA. The collection is split into _id ranges, the rows of the IDs of each
+// range are looked up in HANA, and only the ranges whose checksums differ are
+// compared ID by ID. The rows of IDs that are in no range are extra.
+func Reconcile(ctx context.Context, mongoDB *mongodb.DB, hanaDB *hana.DB, cfg Config, rc ReconcileConfig,
+	name string) (*ReconcileReport, error) {
+	e, ok := entities[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown entity %s", name)
+	}
+	report := &ReconcileReport{Entity: name}
+
+	// compare the counts
+	err := withTimeout(ctx, cfg, name, operationRead, func(ctx context.Context) (err error) {
+		report.MongoCount, err = mongoDB.GetCount(ctx, mongodb.MAIN_DATABASE, e.collection)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("counting %s in MongoDB: %v", name, err)
+	}
+	if report.HanaCount, err = hana.CountRows(ctx, hanaDB, e.table); err != nil {
+		return nil, err
+	}
+
+	var buckets []mongodb.Partition
+	err = withTimeout(ctx, cfg, name, operationRead, func(ctx context.Context) (err error) {
+		buckets, err = mongoDB.GetPartitions(ctx, mongodb.MAIN_DATABASE, e.collection, rc.Buckets)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("splitting %s into buckets: %v", name, err)
+	}
+
+	// compare the checksums of the buckets, the _id order of MongoDB differs
+	// from the ID order of HANA for numbers and ObjectIDs, so the rows are
+	// looked up by the IDs of the documents rather than by range
+	seen := make(map[string]struct{}, report.MongoCount)
+	for _, b := range buckets {
+		if err = reconcileBucket(ctx, mongoDB, hanaDB, cfg, rc, e, b, seen, report); err != nil {
+			return nil, err
+		}
+	}
+
+	// the rows left have no document
+	if err = hana.ScanRows(ctx, hanaDB, e.table, nil, func(id string, _ []interface{}) error {
+		if _, ok := seen[id]; !ok {
+			report.ExtraCount++
+			report.Extra = appendID(report.Extra, id)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(report.Missing)
+	sort.Strings(report.Extra)
+	sort.Strings(report.Different)
+	reconciledRows := cfg.metrics().reconciledRows
+	reconciledRows.WithLabelValues(name, "missing").Set(float64(report.MissingCount))
+	reconciledRows.WithLabelValues(name, "extra").Set(float64(report.ExtraCount))
+	reconciledRows.WithLabelValues(name, "different").Set(float64(report.DifferentCount))
+	return report, nil
+}
+
+func reconcileBucket(ctx context.Context, mongoDB *mongodb.DB, hanaDB *hana.DB, cfg Config, rc ReconcileConfig,
+	e entity, b mongodb.Partition, seen map[string]struct{}, report *ReconcileReport) error {
+	// hash the documents of the bucket and their rows
+	mongoHashes := make(map[string]uint64)
+	sourceIDs := make(map[string]interface{})
+	hanaHashes := make(map[string]uint64)
+	var mongoChecksum, hanaChecksum uint64
+	_, invalid, err := scanBucket(ctx, mongoDB, hanaDB, cfg, e, b, seen,
+		func(id string, source interface{}, values []interface{}) {
+			h := rowHash(values)
+			mongoHashes[id] = h
+			sourceIDs[id] = source
+			mongoChecksum += h
+		},
+		func(id string, values []interface{}) error {
+			h := rowHash(values)
+			hanaHashes[id] = h
+			hanaChecksum += h
+			return nil
+		})
+	report.Invalid += invalid
+	if err != nil {
+		return err
+	}
+
+	if len(mongoHashes) == len(hanaHashes) && mongoChecksum == hanaChecksum {
+		return nil
+	}
+	report.Buckets = append(report.Buckets, BucketReport{
+		Lower:         boundKey(b.Lower),
+		Upper:         boundKey(b.Upper),
+		MongoRows:     len(mongoHashes),
+		HanaRows:      len(hanaHashes),
+		MongoChecksum: strconv.FormatUint(mongoChecksum, 16),
+		HanaChecksum:  strconv.FormatUint(hanaChecksum, 16),
+	})
+
+	// find the IDs that differ
+	var missing, different []interface{}
+	for id, h := range mongoHashes {
+		hanaHash, ok := hanaHashes[id]
+		switch {
+		case !ok:
+			missing = append(missing, sourceIDs[id])
+			report.MissingCount++
+			report.Missing = appendID(report.Missing, id)
+		case hanaHash != h:
+			different = append(different, sourceIDs[id])
+			report.DifferentCount++
+			report.Different = appendID(report.Different, id)
+		}
+	}
+	if !rc.Enqueue {
+		return nil
+	}
+	// extra rows are only reported, they may belong to deleted documents
+	for reason, ids := range map[string][]interface{}{RESYNC_MISSING: missing, RESYNC_DIFFERENT: different} {
+		if err := withTimeout(ctx, cfg, e.name, operationCheckpoint, func(ctx context.Context) error {
+			return mongoDB.EnqueueResync(ctx, e.name, reason, ids)
+		}); err != nil {
+			return fmt.Errorf("enqueueing %s for re-sync: %v", e.name, err)
+		}
+		report.Enqueued += len(ids)
+	}
+	return nil
+}
+
+// boundKey formats a bucket bound for the report, or "" if it is open.
+func boundKey(bound interface{}) string {
+	if bound == nil {
+		return ""
+	}
+	return fmt.Sprint(bound)
+}
+
+func appendID(ids []string, id string) []string {
+	if len(ids) >= maxReportedIDs {
+		return ids
+	}
+	return append(ids, id)
+}
+
+// scanBucket transforms the documents of bucket b and looks up the rows of
+// the valid ones in HANA by ID. It calls doc with every transformed document
+// and its _id, then row with every row found, and adds the IDs of all
+// documents to seen. It returns the number of documents read and of those
+// that cannot be transformed.
+func scanBucket(ctx context.Context, mongoDB *mongodb.DB, hanaDB *hana.DB, cfg Config, e entity, b mongodb.Partition,
+	seen map[string]struct{}, doc func(id string, source interface{}, values []interface{}),
+	row func(id string, values []interface{}) error) (read, invalid int64, err error) {
+	var ids []string
+	for p := b; !p.Done; {
+		var docs []map[string]interface{}
+		err = withTimeout(ctx, cfg, e.name, operationRead, func(ctx context.Context) (err error) {
+			docs, err = mongoDB.GetRange(ctx, mongodb.MAIN_DATABASE, e.collection, p, int64(cfg.pageSize()))
+			return err
+		})
+		if err != nil {
+			return read, invalid, fmt.Errorf("getting %s from MongoDB: %v", e.name, err)
+		}
+		read += int64(len(docs))
+		for _, d := range docs {
+			id := documentKey(d)
+			seen[id] = struct{}{}
+			rec, err := e.transform(zap.NewNop(), d)
+			if err != nil {
+				invalid++
+				continue
+			}
+			ids = append(ids, id)
+			doc(id, d["_id"], rec.values())
+		}
+		if len(docs) > 0 {
+			p.Last = docs[len(docs)-1]["_id"]
+		}
+		p.Done = len(docs) < cfg.pageSize()
+	}
+	return read, invalid, hana.ScanRowsByID(ctx, hanaDB, e.table, e.columns, ids, row)
+}
@@ -0,0 +1,91 @@
+package schedulers
+
+import (
+	"context"
+	"fmt"
+	"go-hana/internal/hana"
+	"go-hana/internal/mongodb"
+	"go-hana/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// resync loads the documents of the entity that are queued for re-sync, and
+// removes them from the queue. Documents that no longer exist are dropped.
+// With an assignment, every document is re-synced by the replica that owns
+// it, the others are left in the queue for their owners.
+func resync(ctx context.Context, mongoDB *mongodb.DB, hanaDB *hana.DB, cfg Config, e entity) (err error) {
+	ctx, span := cfg.tracer().Start(ctx, "resync", trace.WithAttributes(attribute.String("entity", e.name)))
+	defer func() {
+		tracing.End(span, err)
+	}()
+	cfg = cfg.with(tracing.TraceField(ctx))
+	lg := cfg.logger()
+	var last interface{}
+	for {
+		if err := cfg.pause(ctx); err != nil {
+			return err
+		}
+
+		var items []mongodb.ResyncItem
+		err := withTimeout(ctx, cfg, e.name, operationRead, func(ctx context.Context) (err error) {
+			items, err = mongoDB.GetResync(ctx, e.name, last, int64(cfg.pageSize()))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("getting %s queued for re-sync: %v", e.name, err)
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		last = items[len(items)-1].ID
+
+		if ids := ownedResync(cfg, e.name, items); len(ids) > 0 {
+			var docs []map[string]interface{}
+			err = withTimeout(ctx, cfg, e.name, operationRead, func(ctx context.Context) (err error) {
+				docs, err = mongoDB.GetByIDs(ctx, mongodb.MAIN_DATABASE, e.collection, ids)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("getting %s from MongoDB: %v", e.name, err)
+			}
+
+			for _, doc := range docs {
+				if _, err = load(ctx, hanaDB, cfg, e, doc); err != nil {
+					if ctx.Err() != nil {
+						return ctx.Err()
+					}
+					lg.Error("error while re-syncing document", append(errorFields(err), documentField(doc))...)
+					cfg.metrics().failedToLoad(e.name, err)
+					deadLetter(ctx, hanaDB, cfg, e, doc, err)
+					continue
+				}
+				cfg.metrics().loaded(e.name)
+			}
+
+			if err = withTimeout(ctx, cfg, e.name, operationCheckpoint, func(ctx context.Context) error {
+				return mongoDB.DequeueResync(ctx, e.name, ids)
+			}); err != nil {
+				return fmt.Errorf("dequeueing %s: %v", e.name, err)
+			}
+			lg.Info("re-synced queued documents", zap.Int("found", len(docs)), zap.Int("queued", len(ids)))
+		}
+		if len(items) < cfg.pageSize() {
+			return nil
+		}
+	}
+}
+
+// ownedResync returns the _ids of the queued documents that are assigned to
+// this replica, which are all of them without an assignment.
+func ownedResync(cfg Config, entity string, items []mongodb.ResyncItem) []interface{} {
+	ids := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		if cfg.Assignment != nil && !cfg.Assignment.Owns("resync/"+entity+"/"+fmt.Sprint(item.SourceID)) {
+			continue
+		}
+		ids = append(ids, item.SourceID)
+	}
+	return ids
+}
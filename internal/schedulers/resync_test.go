@@ -0,0 +1,35 @@
+package schedulers
+
+import (
+	"go-hana/internal/mongodb"
+	"reflect"
+	"testing"
+)
+
+// keys is an assignment of a fixed set of keys.
+type keys map[string]bool
+
+func (k keys) Owns(key string) bool     { return k[key] }
+func (k keys) Changed() <-chan struct{} { return nil }
+
+func TestOwnedResync(t *testing.T) {
+	items := []mongodb.ResyncItem{{SourceID: int32(1)}, {SourceID: int32(2)}, {SourceID: "a"}}
+	tests := []struct {
+		name       string
+		assignment Assignment
+		want       []interface{}
+	}{
+		{name: "no assignment", assignment: nil, want: []interface{}{int32(1), int32(2), "a"}},
+		{name: "some", assignment: keys{"resync/shops/2": true, "resync/shops/a": true}, want: []interface{}{int32(2), "a"}},
+		{name: "other entity", assignment: keys{"resync/products/1": true}, want: []interface{}{}},
+		{name: "partition key", assignment: keys{"shops/1": true}, want: []interface{}{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ownedResync(Config{Assignment: tt.assignment}, SHOPS, items)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ownedResync() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
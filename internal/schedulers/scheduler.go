@@ -0,0 +1,402 @@
+package schedulers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go-hana/internal/hana"
+	"go-hana/internal/mongodb"
+	"go-hana/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"sort"
+	"time"
+)
+
+const (
+	// defaultPageSize is the number of documents read from MongoDB at once
+	// if the config sets none
+	defaultPageSize = 1000
+)
+
+const (
+	OFFERS       = "offers"
+	PRODUCTS     = "products"
+	SHOPS        = "shops"
+	SHOP_REVIEWS = "shop_reviews"
+)
+
+// Config holds the settings of a single scheduler.
+type Config struct {
+	// Workers is the number of documents written to HANA concurrently.
+	Workers int
+	// Partitions is the number of _id ranges read from MongoDB concurrently.
+	Partitions int
+	// PageSize is the number of documents read from MongoDB at once, 1000
+	// if it is 0.
+	PageSize int
+	// GracePeriod is how long the documents already read are still written
+	// after the scheduler is stopped.
+	GracePeriod time.Duration
+	// Assignment decides which partitions are loaded by this replica. All
+	// of them are if it is nil.
+	Assignment Assignment
+	// Coordinator orders the passes of dependent entities. Passes are not
+	// ordered if it is nil.
+	Coordinator *Coordinator
+	// Retry is how documents are retried after transient HANA errors.
+	Retry Retry
+	// Timeouts are the deadlines of single database operations.
+	Timeouts Timeouts
+	// Breaker pauses the pipelines while the databases are unavailable.
+	// Pipelines are never paused if it is nil.
+	Breaker Breaker
+	// Control pauses, triggers and cancels the pipeline at runtime. The
+	// pipeline runs on its own if it is nil.
+	Control *Control
+	// PassInterval is the wait between the end of a pass and the start of
+	// the next one, passes run back to back if it is zero.
+	PassInterval time.Duration
+	// Logger receives the logs of the pipeline. They are discarded if it is
+	// nil.
+	Logger *zap.Logger
+	// Metrics are the metrics of the pipeline. They are not exported if it
+	// is nil.
+	Metrics *Metrics
+	// TracerProvider records the spans of the runs, pages and documents.
+	// They are not recorded if it is nil.
+	TracerProvider trace.TracerProvider
+}
+
+// Retry bounds the retries of a document after transient HANA errors, like
+// lock wait timeouts, deadlocks and lost connections.
+type Retry struct {
+	// Attempts is the maximum number of times a document is written. It is
+	// written once if Attempts is less than 2.
+	Attempts int
+	// Backoff is the wait before the first retry, doubled on every retry up
+	// to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Assignment divides the partitions of every entity among the replicas.
+type Assignment interface {
+	// Owns reports whether the partition key is assigned to this replica.
+	Owns(key string) bool
+	// Changed returns a channel that is closed when the assignment changes.
+	Changed() <-chan struct{}
+}
+
+// Breaker is a circuit breaker that is tripped while HANA or MongoDB is
+// unavailable.
+type Breaker interface {
+	// Wait blocks while the breaker is tripped or until ctx is cancelled.
+	Wait(ctx context.Context) error
+	// Tripped reports whether the breaker is tripped.
+	Tripped() bool
+}
+
+// pause blocks while the breaker is tripped or the pipeline is paused. It is
+// called before every unit of work, which is recorded as progress.
+func (cfg Config) pause(ctx context.Context) error {
+	if err := cfg.Control.wait(ctx); err != nil {
+		return err
+	}
+	if cfg.Breaker != nil {
+		if err := cfg.Breaker.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	cfg.Control.progress()
+	return nil
+}
+
+func (cfg Config) pageSize() int {
+	if cfg.PageSize <= 0 {
+		return defaultPageSize
+	}
+	return cfg.PageSize
+}
+
+func (cfg Config) tripped() bool {
+	return cfg.Breaker != nil && cfg.Breaker.Tripped()
+}
+
+// record is a MongoDB document transformed into its HANA representation.
+type record interface {
+	// values returns the values of the mapped columns of the entity's table,
+	// in the order of its columns.
+	values() []interface{}
+	// write stores the record inside tx and reports what it did.
+	write(ctx context.Context, tx *sql.Tx) (outcome, error)
+}
+
+// resolver is implemented by records that reference dimension tables. The
+// dimensions are resolved before the record's transaction is started, so a
+// worker never holds two connections at once.
+type resolver interface {
+	resolve(ctx context.Context, lg *zap.Logger, hanaDB *hana.DB) error
+}
+
+// entity describes how one MongoDB collection is loaded into HANA.
+type entity struct {
+	name       string
+	collection string
+	transform  func(lg *zap.Logger, doc map[string]interface{}) (record, error)
+
+	// table is the HANA table of the entity, keyed by the document _id, and
+	// columns are its columns mapped from the document
+	table   string
+	columns []string
+}
+
+// entities are the loaded entities by name.
+var entities = map[string]entity{
+	OFFERS:       offerEntity,
+	PRODUCTS:     productEntity,
+	SHOPS:        shopEntity,
+	SHOP_REVIEWS: shopReviewEntity,
+}
+
+// EntityNames returns the names of all loaded entities.
+func EntityNames() []string {
+	names := make([]string, 0, len(entities))
+	for name := range entities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run loads the entity name over and over again, like its scheduler.
+func Run(ctx context.Context, mongoDB *mongodb.DB, hanaDB *hana.DB, cfg Config, name string) error {
+	e, ok := entities[name]
+	if !ok {
+		return fmt.Errorf("unknown entity %s", name)
+	}
+	return run(ctx, mongoDB, hanaDB, cfg, e)
+}
+
+// Sync loads the documents of the entity name queued for re-sync and then
+// runs a single pass over it, or finishes the pass that is in progress. It
+// returns the run of the pass, which is nil if the pass did not start.
+func Sync(ctx context.Context, mongoDB *mongodb.DB, hanaDB *hana.DB, cfg Config, name string) (*hana.Run, error) {
+	e, ok := entities[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown entity %s", name)
+	}
+	cfg = cfg.with(zap.String("entity", e.name))
+	if err := resync(ctx, mongoDB, hanaDB, cfg, e); err != nil {
+		return nil, err
+	}
+	return runPass(ctx, mongoDB, hanaDB, cfg, e)
+}
+
+// run loads the entity over and over again until ctx is cancelled or a pass
+// fails. Failed passes are restarted by the supervisor.
+func run(ctx context.Context, mongoDB *mongodb.DB, hanaDB *hana.DB, cfg Config, e entity) error {
+	cfg = cfg.with(zap.String("entity", e.name))
+	lg := cfg.logger()
+	defer cfg.Control.setState(STATE_STOPPED)
+	for {
+		cfg.Control.setState(STATE_WAITING)
+		if err := cfg.Coordinator.wait(ctx, lg, e.name); err != nil {
+			return err
+		}
+		lg.Info("starting scheduler")
+		cfg.Control.setState(STATE_RUNNING)
+
+		// documents queued by the reconciliation go first
+		if err := resync(ctx, mongoDB, hanaDB, cfg, e); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("error in %s scheduler: %v", e.name, err)
+		}
+
+		// 1. Split the collection into _id ranges, or resume the ranges of an unfinished pass
+		// 2. Read the ranges assigned to this replica concurrently by pages, ordered by _id
+		// 3. Hand every document over to the worker pool, which inserts it into HANA
+		// 4. When all ranges are inserted by all replicas, restart the scheduler
+		passCtx, cancel := cfg.Control.startPass(ctx)
+		_, err := runPass(passCtx, mongoDB, hanaDB, cfg, e)
+		cancel()
+		cancelled := cfg.Control.finishPass(err)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case cancelled:
+			lg.Info("scheduler is cancelled")
+		case err != nil:
+			return fmt.Errorf("error in %s scheduler: %v", e.name, err)
+		default:
+			cfg.Coordinator.finish(e.name)
+			lg.Info("scheduler is done")
+		}
+
+		if err = cfg.Control.next(ctx, cfg.PassInterval, cancelled); err != nil {
+			return err
+		}
+	}
+}
+
+// drainContext returns a context that carries the values of ctx and is
+// cancelled grace after ctx is done.
+func drainContext(ctx context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	drainCtx, cancel := context.WithCancel(detachedContext{ctx})
+	go func() {
+		select {
+		case <-ctx.Done():
+			select {
+			case <-time.After(grace):
+			case <-drainCtx.Done():
+			}
+			cancel()
+		case <-drainCtx.Done():
+		}
+	}()
+	return drainCtx, cancel
+}
+
+// detachedContext carries the values of its parent but not its cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// loader returns the handler of a worker pool that loads documents of the
+// entity into HANA. Failed documents are counted in st and dead-lettered,
+// only documents interrupted by ctx are returned as errors. The span of
+// every document is a child of the span it was submitted in.
+func loader(ctx context.Context, hanaDB *hana.DB, cfg Config, e entity,
+	st *stats) func(parent trace.SpanContext, doc map[string]interface{}) error {
+	lg := cfg.logger()
+	return func(parent trace.SpanContext, doc map[string]interface{}) error {
+		ctx := trace.ContextWithSpanContext(ctx, parent)
+		if err := cfg.pause(ctx); err != nil {
+			return err
+		}
+		o, err := load(ctx, hanaDB, cfg, e, doc)
+		for err != nil && cfg.tripped() && ctx.Err() == nil {
+			// the databases went away while loading, retry once they are back
+			if err = cfg.pause(ctx); err == nil {
+				o, err = load(ctx, hanaDB, cfg, e, doc)
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				// interrupted by shutdown, the document is loaded again on the next start
+				return err
+			}
+			lg.Error("error while loading document", append(errorFields(err), documentField(doc))...)
+			cfg.metrics().failedToLoad(e.name, err)
+			st.addFailure(err)
+			deadLetter(ctx, hanaDB, cfg, e, doc, err)
+			return nil
+		}
+		cfg.metrics().loaded(e.name)
+		st.addOutcome(o)
+		return nil
+	}
+}
+
+// load transforms doc and writes it to HANA in its own transaction, which is
+// rolled back if ctx is cancelled before it is committed. Transient errors
+// and timeouts are retried as set by cfg, permanent ones are returned right
+// away.
+func load(ctx context.Context, hanaDB *hana.DB, cfg Config, e entity, doc map[string]interface{}) (o outcome, err error) {
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	ctx, span := cfg.tracer().Start(ctx, "document", trace.WithAttributes(
+		attribute.String("entity", e.name), attribute.String("document_id", documentKey(doc))))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	lg := cfg.logger().With(documentField(doc), tracing.SpanField(ctx))
+	started := time.Now()
+	var rec record
+	rec, err = e.transform(lg, doc)
+	cfg.metrics().transformDuration.WithLabelValues(e.name).Observe(time.Since(started).Seconds())
+	if err != nil {
+		return 0, &stageError{stage: stageTransform, err: err}
+	}
+
+	retry := cfg.Retry
+	backoff := retry.Backoff
+	for attempt := 1; ; attempt++ {
+		span.SetAttributes(attribute.Int("attempts", attempt))
+		err = withTimeout(ctx, cfg, e.name, operationWrite, func(ctx context.Context) error {
+			o, err = write(ctx, lg, hanaDB, e.name, documentKey(doc), rec,
+				cfg.metrics().commitDuration.WithLabelValues(e.name))
+			return err
+		})
+		if err == nil || attempt >= retry.Attempts || ctx.Err() != nil ||
+			!(hana.IsTransient(err) || errors.Is(err, context.DeadlineExceeded)) {
+			return o, err
+		}
+		cfg.metrics().retries.WithLabelValues(e.name).Inc()
+		lg.Debug("retrying document", append(errorFields(err), zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff))...)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return 0, err
+		}
+		if backoff *= 2; retry.MaxBackoff > 0 && backoff > retry.MaxBackoff {
+			backoff = retry.MaxBackoff
+		}
+	}
+}
+
+// write resolves the dimensions of rec and writes it in a transaction, whose
+// duration is observed by commit. The dead letter of the document, if any,
+// is removed in the same transaction.
+func write(ctx context.Context, lg *zap.Logger, hanaDB *hana.DB, entity, sourceID string, rec record,
+	commit prometheus.Observer) (outcome, error) {
+	if r, ok := rec.(resolver); ok {
+		if err := r.resolve(ctx, lg, hanaDB); err != nil {
+			return 0, &stageError{stage: stageResolve, err: err}
+		}
+	}
+
+	// start transaction
+	started := time.Now()
+	tx, err := hanaDB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, &stageError{stage: stageWrite, err: fmt.Errorf("starting transaction: %w", err)}
+	}
+	defer tx.Rollback()
+
+	if err = hana.CheckFence(ctx, tx); err != nil {
+		return 0, &stageError{stage: stageWrite, err: err}
+	}
+	o, err := rec.write(ctx, tx)
+	if err != nil {
+		return 0, &stageError{stage: stageWrite, err: err}
+	}
+	if err = hana.ClearDeadLetter(ctx, tx, entity, sourceID); err != nil {
+		return 0, &stageError{stage: stageWrite, err: err}
+	}
+
+	// commit transaction
+	if err = tx.Commit(); err != nil {
+		return 0, &stageError{stage: stageWrite, err: fmt.Errorf("committing transaction: %w", err)}
+	}
+	commit.Observe(time.Since(started).Seconds())
+	return o, nil
+}
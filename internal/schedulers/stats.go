@@ -0,0 +1,182 @@
+package schedulers
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"go-hana/internal/hana"
+	"go.uber.org/zap"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxErrors is the number of distinct errors kept for the run summary
+	maxErrors = 10
+)
+
+// outcome is what writing a record did in HANA.
+type outcome int
+
+const (
+	inserted outcome = iota
+	updated
+	skipped
+)
+
+// stats counts what a pass did, to be recorded in ETL_RUNS.
+type stats struct {
+	read     int64
+	inserted int64
+	updated  int64
+	skipped  int64
+	failed   int64
+
+	mu     sync.Mutex
+	errors map[string]int
+}
+
+func (s *stats) addRead(n int) {
+	atomic.AddInt64(&s.read, int64(n))
+}
+
+func (s *stats) addOutcome(o outcome) {
+	switch o {
+	case inserted:
+		atomic.AddInt64(&s.inserted, 1)
+	case updated:
+		atomic.AddInt64(&s.updated, 1)
+	case skipped:
+		atomic.AddInt64(&s.skipped, 1)
+	}
+}
+
+func (s *stats) addFailure(err error) {
+	atomic.AddInt64(&s.failed, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.errors == nil {
+		s.errors = make(map[string]int)
+	}
+	msg := err.Error()
+	if _, ok := s.errors[msg]; ok || len(s.errors) < maxErrors {
+		s.errors[msg]++
+	}
+}
+
+// summary lists the distinct document errors, most frequent first.
+func (s *stats) summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgs := make([]string, 0, len(s.errors))
+	for msg := range s.errors {
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		if s.errors[msgs[i]] != s.errors[msgs[j]] {
+			return s.errors[msgs[i]] > s.errors[msgs[j]]
+		}
+		return msgs[i] < msgs[j]
+	})
+	for i, msg := range msgs {
+		msgs[i] = fmt.Sprintf("%s (x%d)", msg, s.errors[msg])
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// runRecorder keeps the ETL_RUNS row of a pass up to date.
+type runRecorder struct {
+	// ctx is not cancelled with the pass, so the end of the pass is recorded
+	ctx    context.Context
+	hanaDB *hana.DB
+	cfg    Config
+	lg     *zap.Logger
+	run    hana.Run
+	stats  *stats
+}
+
+func newRunRecorder(ctx context.Context, hanaDB *hana.DB, cfg Config, entity string) *runRecorder {
+	host, _ := os.Hostname()
+	id := newRunID()
+	return &runRecorder{
+		ctx:    detachedContext{ctx},
+		hanaDB: hanaDB,
+		cfg:    cfg,
+		lg:     cfg.logger().With(zap.String("run_id", id)),
+		run: hana.Run{
+			ID:        id,
+			Entity:    entity,
+			Mode:      hana.RUN_MODE_FULL,
+			Host:      host,
+			StartedAt: time.Now(),
+			Status:    hana.RUN_STATUS_RUNNING,
+		},
+		stats: &stats{},
+	}
+}
+
+// start records the run as running.
+func (r *runRecorder) start(mode string, pass int64) {
+	r.run.Mode = mode
+	r.run.Pass = pass
+	r.save()
+}
+
+// finish records the final statistics and status of the run.
+func (r *runRecorder) finish(err error, interrupted bool) {
+	r.run.FinishedAt = time.Now()
+	r.run.Read = atomic.LoadInt64(&r.stats.read)
+	r.run.Inserted = atomic.LoadInt64(&r.stats.inserted)
+	r.run.Updated = atomic.LoadInt64(&r.stats.updated)
+	r.run.Skipped = atomic.LoadInt64(&r.stats.skipped)
+	r.run.Failed = atomic.LoadInt64(&r.stats.failed)
+
+	var errs []string
+	switch {
+	case interrupted:
+		r.run.Status = hana.RUN_STATUS_INTERRUPTED
+	case err != nil:
+		r.run.Status = hana.RUN_STATUS_FAILED
+	case r.run.Failed > 0:
+		r.run.Status = hana.RUN_STATUS_PARTIAL
+	default:
+		r.run.Status = hana.RUN_STATUS_SUCCEEDED
+	}
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	if summary := r.stats.summary(); summary != "" {
+		errs = append(errs, summary)
+	}
+	r.run.Error = strings.Join(errs, "; ")
+	r.save()
+	r.cfg.metrics().passFinished(r.run)
+	r.lg.Info("run finished", zap.String("mode", r.run.Mode), zap.Int64("pass", r.run.Pass),
+		zap.String("status", r.run.Status), zap.Int64("read", r.run.Read), zap.Int64("inserted", r.run.Inserted),
+		zap.Int64("updated", r.run.Updated), zap.Int64("skipped", r.run.Skipped), zap.Int64("failed", r.run.Failed),
+		zap.Duration("duration", r.run.FinishedAt.Sub(r.run.StartedAt)))
+}
+
+func (r *runRecorder) save() {
+	// the run history must not stop the loading
+	if err := withTimeout(r.ctx, r.cfg, r.run.Entity, operationCheckpoint, func(ctx context.Context) error {
+		return hana.SaveRun(ctx, r.hanaDB, &r.run)
+	}); err != nil {
+		r.lg.Error("error while recording run", zap.Error(err))
+	}
+}
+
+// newRunID returns a random UUID.
+func newRunID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
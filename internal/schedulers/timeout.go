@@ -0,0 +1,53 @@
+package schedulers
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// operations bounded by the timeouts
+	operationRead       = "read"
+	operationWrite      = "write"
+	operationCheckpoint = "checkpoint"
+)
+
+// Timeouts are the deadlines of single database operations. An operation
+// has no deadline of its own if its timeout is 0.
+type Timeouts struct {
+	// Read bounds reading a page or a checkpoint from MongoDB.
+	Read time.Duration
+	// Write bounds a single attempt to write a document to HANA.
+	Write time.Duration
+	// Checkpoint bounds saving checkpoints, runs and dead letters.
+	Checkpoint time.Duration
+}
+
+func (t Timeouts) of(operation string) time.Duration {
+	switch operation {
+	case operationRead:
+		return t.Read
+	case operationWrite:
+		return t.Write
+	case operationCheckpoint:
+		return t.Checkpoint
+	}
+	return 0
+}
+
+// withTimeout runs op with a context that expires after the timeout of the
+// operation in cfg, and counts the operation if it ran out of time.
+func withTimeout(ctx context.Context, cfg Config, entity, operation string, op func(ctx context.Context) error) error {
+	if d := cfg.Timeouts.of(operation); d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	err := op(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		cfg.metrics().timeouts.WithLabelValues(entity, operation).Inc()
+	}
+	return err
+}
@@ -0,0 +1,17 @@
+package schedulers
+
+import (
+	"go-hana/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// instrumentationName names the tracer of the runs, pages and documents
+	instrumentationName = "go-hana/internal/schedulers"
+)
+
+// tracer returns the tracer of the pipeline, which records nothing if cfg
+// has no tracer provider.
+func (cfg Config) tracer() trace.Tracer {
+	return tracing.Provider(cfg.TracerProvider).Tracer(instrumentationName)
+}
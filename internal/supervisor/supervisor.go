@@ -0,0 +1,154 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Policy controls how failed pipelines are restarted.
+type Policy struct {
+	// InitialBackoff is the delay before the first restart. It doubles on
+	// every consecutive failure up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter is the fraction of the backoff added at random, so pipelines
+	// failing together don't restart in lockstep.
+	Jitter float64
+	// MaxRestarts is the number of restarts allowed within Window. Once it is
+	// exhausted the pipeline is marked as degraded and restarted only when
+	// the oldest restart leaves the window.
+	MaxRestarts int
+	Window      time.Duration
+}
+
+// Supervisor runs pipelines and restarts the failed ones, so one entity's
+// failure never affects the others.
+type Supervisor struct {
+	policy   Policy
+	lg       *zap.Logger
+	children []child
+
+	restarts *prometheus.CounterVec
+	degraded *prometheus.GaugeVec
+}
+
+type child struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+func New(lg *zap.Logger, reg prometheus.Registerer, policy Policy) *Supervisor {
+	factory := promauto.With(reg)
+	return &Supervisor{
+		policy: policy,
+		lg:     lg,
+		restarts: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "pipeline_restarts_total",
+			Help: "The total number of pipeline restarts after a failure",
+		}, []string{"entity"}),
+		degraded: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "pipeline_degraded",
+			Help: "Whether the pipeline exhausted its restart budget (1) or not (0)",
+		}, []string{"entity"}),
+	}
+}
+
+// Add registers a pipeline. run is expected to block until ctx is cancelled
+// and to return an error if the pipeline fails.
+func (s *Supervisor) Add(name string, run func(ctx context.Context) error) {
+	s.children = append(s.children, child{name: name, run: run})
+}
+
+// Run starts all pipelines and blocks until ctx is cancelled and every
+// pipeline has stopped.
+func (s *Supervisor) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, c := range s.children {
+		c := c
+		s.degraded.WithLabelValues(c.name).Set(0)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.supervise(ctx, c)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Supervisor) supervise(ctx context.Context, c child) {
+	lg := s.lg.With(zap.String("pipeline", c.name))
+	degraded := s.degraded.WithLabelValues(c.name)
+	backoff := s.policy.InitialBackoff
+	var restarts []time.Time
+
+	for {
+		// a pipeline that runs for a whole window is healthy again
+		healthy := time.AfterFunc(s.policy.Window, func() {
+			degraded.Set(0)
+		})
+		started := time.Now()
+		err := runSafely(ctx, c)
+		healthy.Stop()
+
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) >= s.policy.Window {
+			restarts = restarts[:0]
+			backoff = s.policy.InitialBackoff
+		}
+		lg.Error("pipeline failed", zap.Error(err))
+
+		delay := s.jitter(backoff)
+		if backoff *= 2; backoff > s.policy.MaxBackoff {
+			backoff = s.policy.MaxBackoff
+		}
+
+		// drop the restarts that left the window
+		now := time.Now()
+		for len(restarts) > 0 && now.Sub(restarts[0]) >= s.policy.Window {
+			restarts = restarts[1:]
+		}
+		if s.policy.MaxRestarts > 0 && len(restarts) >= s.policy.MaxRestarts {
+			lg.Warn("marking pipeline as degraded", zap.Int("restarts", len(restarts)),
+				zap.Duration("window", s.policy.Window))
+			degraded.Set(1)
+			if wait := restarts[0].Add(s.policy.Window).Sub(now); wait > delay {
+				delay = wait
+			}
+		}
+
+		lg.Info("restarting pipeline", zap.Duration("delay", delay))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		restarts = append(restarts, time.Now())
+		s.restarts.WithLabelValues(c.name).Inc()
+	}
+}
+
+// runSafely runs the pipeline, turning a panic into an error.
+func runSafely(ctx context.Context, c child) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return c.run(ctx)
+}
+
+func (s *Supervisor) jitter(d time.Duration) time.Duration {
+	if s.policy.Jitter <= 0 || d <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Float64()*s.policy.Jitter*float64(d))
+}
@@ -0,0 +1,154 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newSupervisor(policy Policy) *Supervisor {
+	return New(zap.NewNop(), prometheus.NewRegistry(), policy)
+}
+
+// starts records when a pipeline was started.
+type starts struct {
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (s *starts) add() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.times = append(s.times, time.Now())
+	return len(s.times)
+}
+
+func (s *starts) gaps() []time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var gaps []time.Duration
+	for i := 1; i < len(s.times); i++ {
+		gaps = append(gaps, s.times[i].Sub(s.times[i-1]))
+	}
+	return gaps
+}
+
+// failing returns a pipeline that fails n times and then runs until ctx is
+// cancelled, which cancel is called for.
+func failing(st *starts, n int, cancel context.CancelFunc) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if st.add() > n {
+			cancel()
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return errors.New("failed")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := newSupervisor(Policy{InitialBackoff: 20 * time.Millisecond, MaxBackoff: 40 * time.Millisecond, Window: time.Hour})
+	st := &starts{}
+	s.Add("shops", failing(st, 3, cancel))
+	s.Run(ctx)
+
+	// the backoff doubles up to its maximum
+	want := []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond}
+	gaps := st.gaps()
+	if len(gaps) != len(want) {
+		t.Fatalf("pipeline was restarted %d times, want %d", len(gaps), len(want))
+	}
+	for i, gap := range gaps {
+		if gap < want[i] {
+			t.Errorf("restart %d after %s, want at least %s", i+1, gap, want[i])
+		}
+	}
+}
+
+func TestRestartBudget(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	window := 300 * time.Millisecond
+	s := newSupervisor(Policy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRestarts: 2,
+		Window: window})
+	st := &starts{}
+	s.Add("shops", failing(st, 3, cancel))
+	s.Run(ctx)
+
+	// the third restart waits until the first one leaves the window
+	gaps := st.gaps()
+	if len(gaps) != 3 {
+		t.Fatalf("pipeline was restarted %d times, want 3", len(gaps))
+	}
+	if gaps[1] >= window/2 {
+		t.Errorf("second restart after %s, want it within the budget", gaps[1])
+	}
+	if gaps[2] < window-50*time.Millisecond {
+		t.Errorf("third restart after %s, want about %s", gaps[2], window)
+	}
+}
+
+func TestFailureIsIsolated(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newSupervisor(Policy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Window: time.Hour})
+	healthy, failed := &starts{}, &starts{}
+	s.Add("shops", func(ctx context.Context) error {
+		healthy.add()
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	s.Add("products", func(ctx context.Context) error {
+		if failed.add() == 5 {
+			cancel()
+		}
+		panic("products pipeline is broken")
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run() did not return after ctx was cancelled")
+	}
+
+	if n := len(healthy.times); n != 1 {
+		t.Errorf("healthy pipeline was started %d times, want 1", n)
+	}
+	if n := len(failed.times); n < 5 {
+		t.Errorf("panicking pipeline was started %d times, want at least 5", n)
+	}
+}
+
+func TestRunSafely(t *testing.T) {
+	err := runSafely(context.Background(), child{name: "shops", run: func(ctx context.Context) error {
+		panic("nil map")
+	}})
+	if err == nil || !strings.Contains(err.Error(), "panic: nil map") {
+		t.Errorf("runSafely() = %v, want the panic as an error", err)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	d := 100 * time.Millisecond
+	if got := newSupervisor(Policy{}).jitter(d); got != d {
+		t.Errorf("jitter() = %s without jitter, want %s", got, d)
+	}
+	s := newSupervisor(Policy{Jitter: 0.5})
+	for i := 0; i < 100; i++ {
+		if got := s.jitter(d); got < d || got > d+d/2 {
+			t.Fatalf("jitter() = %s, want between %s and %s", got, d, d+d/2)
+		}
+	}
+}
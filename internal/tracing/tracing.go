@@ -0,0 +1,120 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"os"
+)
+
+const (
+	// exporters of the spans
+	EXPORTER_NONE   = "none"
+	EXPORTER_STDOUT = "stdout"
+	EXPORTER_OTLP   = "otlp"
+)
+
+type Config struct {
+	// Exporter is where the spans are sent to, one of the EXPORTER_*
+	// constants. Spans are not recorded at all with EXPORTER_NONE.
+	Exporter string
+	// Endpoint is the host:port of the OTLP gRPC collector.
+	Endpoint string
+	// Insecure connects to the collector without TLS, as to a local one.
+	Insecure bool
+	// SampleRatio is the fraction of the traces that are recorded.
+	SampleRatio float64
+	// ServiceName identifies the replicas in the traces.
+	ServiceName string
+}
+
+// New returns the tracer provider of the exporter set by cfg, and a function
+// that flushes the buffered spans and stops it.
+func New(ctx context.Context, cfg Config) (trace.TracerProvider, func(ctx context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case EXPORTER_NONE, "":
+		return trace.NewNoopTracerProvider(), func(ctx context.Context) error { return nil }, nil
+	case EXPORTER_STDOUT:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case EXPORTER_OTLP:
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, opts...)
+	default:
+		return nil, nil, fmt.Errorf("unknown exporter %s", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create %s exporter: %v", cfg.Exporter, err)
+	}
+
+	host, _ := os.Hostname()
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceNameKey.String(cfg.ServiceName),
+		semconv.HostNameKey.String(host),
+	)
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// the spans of a document follow the decision of its run
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	return provider, provider.Shutdown, nil
+}
+
+// Provider returns tp, or a provider that records nothing if it is nil.
+func Provider(tp trace.TracerProvider) trace.TracerProvider {
+	if tp == nil {
+		return trace.NewNoopTracerProvider()
+	}
+	return tp
+}
+
+// TraceField returns the ID of the trace of ctx as a log field, so the logs
+// can be correlated with the traces. The field is skipped if ctx has no span.
+func TraceField(ctx context.Context) zap.Field {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return zap.Skip()
+	}
+	return zap.String("trace_id", sc.TraceID().String())
+}
+
+// SpanField returns the ID of the span of ctx as a log field. The field is
+// skipped if ctx has no span.
+func SpanField(ctx context.Context) zap.Field {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return zap.Skip()
+	}
+	return zap.String("span_id", sc.SpanID().String())
+}
+
+// TraceID returns the ID of the trace of ctx, or an empty string if ctx has
+// no span.
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// End records err on span, if any, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
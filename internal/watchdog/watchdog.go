@@ -0,0 +1,149 @@
+package watchdog
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go-hana/internal/hana"
+	"go-hana/internal/mongodb"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	// Interval is how often HANA and MongoDB are pinged.
+	Interval time.Duration
+	// Timeout bounds a single ping.
+	Timeout time.Duration
+	// FailureThreshold is the number of consecutive failed checks that trip
+	// the breaker.
+	FailureThreshold int
+}
+
+// Watchdog pings HANA and MongoDB and trips a circuit breaker when either of
+// them stays unavailable, which pauses the pipelines until both are back.
+type Watchdog struct {
+	cfg     Config
+	lg      *zap.Logger
+	mongoDB *mongodb.DB
+	hanaDB  *hana.DB
+
+	breakerState prometheus.Gauge
+	databaseUp   *prometheus.GaugeVec
+
+	mu       sync.Mutex
+	failures int
+	tripped  bool
+	// closed is closed while the breaker is closed
+	closed chan struct{}
+}
+
+func New(lg *zap.Logger, reg prometheus.Registerer, mongoDB *mongodb.DB, hanaDB *hana.DB, cfg Config) *Watchdog {
+	factory := promauto.With(reg)
+	closed := make(chan struct{})
+	close(closed)
+	return &Watchdog{
+		cfg:     cfg,
+		lg:      lg,
+		mongoDB: mongoDB,
+		hanaDB:  hanaDB,
+		closed:  closed,
+		breakerState: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "circuit_breaker_state",
+			Help: "Whether the pipelines are running (0) or paused because a database is unavailable (1)",
+		}),
+		databaseUp: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "database_up",
+			Help: "Whether the last ping of the database succeeded (1) or not (0)",
+		}, []string{"database"}),
+	}
+}
+
+// Run checks the databases every interval until ctx is cancelled.
+func (w *Watchdog) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		w.record(w.check(ctx))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Wait blocks while the breaker is open or until ctx is cancelled.
+func (w *Watchdog) Wait(ctx context.Context) error {
+	w.mu.Lock()
+	closed := w.closed
+	w.mu.Unlock()
+
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Tripped reports whether the breaker is open.
+func (w *Watchdog) Tripped() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.tripped
+}
+
+// check pings both databases and returns the first error.
+func (w *Watchdog) check(ctx context.Context) error {
+	hanaErr := w.ping(ctx, "hana", w.hanaDB.Probe().PingContext)
+	mongoErr := w.ping(ctx, "mongodb", func(ctx context.Context) error {
+		return w.mongoDB.Ping(ctx, readpref.Primary())
+	})
+	if hanaErr != nil {
+		return hanaErr
+	}
+	return mongoErr
+}
+
+func (w *Watchdog) ping(ctx context.Context, database string, ping func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, w.cfg.Timeout)
+	defer cancel()
+
+	if err := ping(ctx); err != nil {
+		w.databaseUp.WithLabelValues(database).Set(0)
+		w.lg.Warn("error while pinging database", zap.String("database", database), zap.Error(err))
+		return err
+	}
+	w.databaseUp.WithLabelValues(database).Set(1)
+	return nil
+}
+
+// record opens the breaker after FailureThreshold consecutive failures and
+// closes it on the first success.
+func (w *Watchdog) record(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err == nil {
+		w.failures = 0
+		if w.tripped {
+			w.tripped = false
+			close(w.closed)
+			w.breakerState.Set(0)
+			w.lg.Info("databases are available again, resuming pipelines")
+		}
+		return
+	}
+
+	w.failures++
+	if !w.tripped && w.failures >= w.cfg.FailureThreshold {
+		w.tripped = true
+		w.closed = make(chan struct{})
+		w.breakerState.Set(1)
+		w.lg.Error("databases are unavailable, pausing pipelines", zap.Int("failed_checks", w.failures))
+	}
+}
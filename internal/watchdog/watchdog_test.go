@@ -0,0 +1,105 @@
+package watchdog
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+var errUnavailable = errors.New("connection refused")
+
+func newWatchdog(cfg Config) *Watchdog {
+	return New(zap.NewNop(), prometheus.NewRegistry(), nil, nil, cfg)
+}
+
+// closed reports whether Wait returns right away.
+func closed(w *Watchdog) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	return w.Wait(ctx) == nil
+}
+
+func TestBreaker(t *testing.T) {
+	w := newWatchdog(Config{FailureThreshold: 3})
+	if w.Tripped() || !closed(w) {
+		t.Fatal("breaker is open before any check")
+	}
+
+	// failures below the threshold keep it closed, a success resets them
+	w.record(errUnavailable)
+	w.record(errUnavailable)
+	w.record(nil)
+	w.record(errUnavailable)
+	w.record(errUnavailable)
+	if w.Tripped() || !closed(w) {
+		t.Fatal("breaker opened before the threshold of consecutive failures")
+	}
+
+	w.record(errUnavailable)
+	if !w.Tripped() || closed(w) {
+		t.Fatal("breaker is closed after the threshold of consecutive failures")
+	}
+	w.record(errUnavailable)
+	if !w.Tripped() {
+		t.Fatal("breaker closed on a further failure")
+	}
+
+	w.record(nil)
+	if w.Tripped() || !closed(w) {
+		t.Fatal("breaker is open after a successful check")
+	}
+}
+
+func TestWaitReleasedOnRecovery(t *testing.T) {
+	w := newWatchdog(Config{FailureThreshold: 1})
+	w.record(errUnavailable)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Wait(context.Background())
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Wait() = %v while the breaker is open", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	w.record(nil)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Wait() = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait() did not return once the breaker closed")
+	}
+}
+
+func TestWaitCancelled(t *testing.T) {
+	w := newWatchdog(Config{FailureThreshold: 1})
+	w.record(errUnavailable)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := w.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestPingTimeout(t *testing.T) {
+	w := newWatchdog(Config{Timeout: 10 * time.Millisecond})
+	// a hanging database counts as unavailable once the timeout is up
+	err := w.ping(context.Background(), "hana", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ping() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err = w.ping(context.Background(), "hana", func(ctx context.Context) error { return nil }); err != nil {
+		t.Errorf("ping() = %v, want nil", err)
+	}
+}